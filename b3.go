@@ -2,13 +2,14 @@ package b3
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	iofs "io/fs"
 	"iter"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -20,6 +21,13 @@ import (
 
 const fRFC3339NanoNumericTZ0pad = "2006-01-02T15:04:05.000000000-07:00"
 
+// StdinPath, given as the path to checksum,
+// means standard input, as in "pg_dump | b3 -".
+const StdinPath = "-"
+
+// MaxSumLen is the longest sum b3 -len will make, in bytes.
+const MaxSumLen = 1 << 20
+
 type Blake3SummerConfig struct {
 	Help bool
 
@@ -37,20 +45,157 @@ type Blake3SummerConfig struct {
 	Xprefix     excludes
 	Xsuffix     excludes
 
+	// Filters are the -glob, -xglob, -re and -xre rules.
+	// They apply on top of the substring match of Globs.
+	Filters filterRules
+
+	// Directory walks honor .b3ignore files, unless
+	// NoIgnore. GitIgnore adds .gitignore files, and
+	// skips .git directories. OnlyIgnored hashes just the
+	// files that the ignore files leave out, instead.
+	NoIgnore    bool
+	GitIgnore   bool
+	OnlyIgnored bool
+
 	PathListStdin bool
 
 	ModTimeHash bool
 
+	// Meta lists the metadata fields (MetaMode, MetaOwner,
+	// MetaUID, MetaXattr, MetaACL) to hash into a separate
+	// metadata digest for each file, in PathSum.Meta.
+	Meta []string
+
 	// output hex string for comparison with other tools?
 	Hex bool
 
-	// skip directory walking.
+	// OutLen is the length in bytes of each sum; 0 means
+	// the default of 33 (32 with -hex). Seek skips that many
+	// bytes into blake3's extended output before taking them.
+	OutLen int
+	Seek   int64
+
+	// KeyPath names a file holding a key for BLAKE3's
+	// keyed hash mode; see loadKeyFile.
+	KeyPath string
+
+	// Context, if set, has us hash in keyed mode with
+	// DeriveKey(Context, key material from KeyPath, if any),
+	// so that sums made under different contexts never match.
+	// This is not b3sum --derive-key; see initKey.
+	Context string
+
+	// skip directory walking. StdinPath ("-")
+	// means hash standard input.
 	SingleFilePath string
 
 	// output paths before hashes, for easier sorting/diffs
 	PathsFirst bool
 
 	Quiet bool
+
+	// verify the sums in this manifest (previous b3 output)
+	// instead of producing new ones.
+	CheckPath string
+
+	// OutPath, if set, is where the manifest is written,
+	// atomically, instead of printing the sums.
+	OutPath string
+
+	// write one JSON document, or one JSON record per
+	// line (NDJSON) as each file is done, instead of text.
+	JSON   bool
+	NDJSON bool
+
+	// TreeVersion selects the format of the hash of
+	// hashes; one of TreeFlat, TreePaths, or TreeMerkle.
+	TreeVersion int
+
+	// Progress reports how the scan is going on stderr.
+	Progress bool
+
+	// Jobs is the most threads to hash with, shared between
+	// the files hashed at once and the threads that each big
+	// file is hashed with; 0 means one per CPU. See cpuBudget.
+	Jobs int
+
+	// HDDJobs is how many files to read at once from each
+	// spinning disk; 0 means 1. See deviceScheduler.
+	HDDJobs int
+
+	// NoPageCache reads each file through a descriptor of
+	// our own, opened with O_NOATIME where permitted, and
+	// drops the pages it read into the page cache once the
+	// file is hashed; see sumUncached. Linux only, elsewhere it
+	// just reads the file through one descriptor.
+	NoPageCache bool
+
+	// Background lowers our CPU and I/O priority, so that
+	// scheduled runs do not slow other work; see enterBackground.
+	// The Mains apply it, not FinishConfig.
+	Background bool
+
+	// print the TreeMerkle hash of each directory
+	// along with the files.
+	DirSums bool
+
+	// Dirs lists each directory walked, empty or not, as
+	// an entry of its own (its path ending in "/"), and
+	// commits it to the hash of hashes; see sumDirEntries.
+	Dirs bool
+
+	// stop at the first file that cannot be checksummed,
+	// rather than reporting all such files and continuing.
+	FailFast bool
+
+	// CachePath, if set, is a file that remembers sums
+	// between runs, so unchanged files are not rehashed.
+	CachePath string
+
+	// ignore the cached sums, rehashing every file,
+	// but still update the cache.
+	Rehash bool
+
+	// drop cache entries for files that no longer exist.
+	PruneCache bool
+
+	// for b3 dupes: compare a hash of the first and last
+	// DupeSample bytes of same sized files before hashing
+	// them in full, and leave out files smaller than
+	// DupeMinSize bytes.
+	DupeSample  int64
+	DupeMinSize int64
+
+	// DupeLink, if set, has b3 dupes replace duplicates
+	// with links (LinkHard or LinkReflink), recording each
+	// in the DupeLog file so they can be undone. DryRun
+	// reports what would be done, without doing it.
+	DupeLink string
+	DupeLog  string
+	DryRun   bool
+
+	cache *hashCache
+
+	// keyMaterial is loaded from KeyPath. key is what we
+	// hash with: keyMaterial, or derived from it and
+	// Context; see initKey. nil means unkeyed.
+	keyMaterial []byte
+	key         []byte
+
+	// ignore is nil with NoIgnore.
+	ignore *Ignorer
+
+	// progress is counting the scan underway, if any.
+	progress *progress
+
+	// sortedWalk has walkTargets find the paths in sorted
+	// order, for streamListing; see walkInOrder.
+	sortedWalk bool
+
+	// budget shares out the threads allowed by Jobs. If
+	// nil (without FinishConfig), each file is hashed
+	// with one thread per CPU, however many run at once.
+	budget *cpuBudget
 }
 
 type excludes struct {
@@ -88,15 +233,43 @@ func (c *Blake3SummerConfig) SetFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&c.Recurse, "r", false, "recursive checksum sub-directories")
 	fs.BoolVar(&c.Version, "version", false, "show version of b3/dependencies")
 
+	fs.Var(&filterFlag{rules: &c.Filters, include: true}, "glob", "keep paths matching this shell glob, where ** matches any number of directories (multiple okay; the last -glob, -xglob, -re or -xre to match a path wins)")
+	fs.Var(&filterFlag{rules: &c.Filters}, "xglob", "drop paths matching this shell glob (see -glob)")
+	fs.Var(&filterFlag{rules: &c.Filters, include: true, isRegex: true}, "re", "keep paths that this regex matches, in full (see -glob)")
+	fs.Var(&filterFlag{rules: &c.Filters, isRegex: true}, "xre", "drop paths that this regex matches, in full (see -glob)")
+	fs.BoolVar(&c.GitIgnore, "gitignore", false, "also honor .gitignore files, and skip .git directories")
+	fs.BoolVar(&c.NoIgnore, "no-ignore", false, "do not honor .b3ignore (or .gitignore) files")
+	fs.BoolVar(&c.OnlyIgnored, "ignored", false, "checksum only the files that .b3ignore (and -gitignore) leave out")
 	fs.Var(&c.Xprefix, "x", "file name prefix to exclude (multiple -x okay; default: '_')")
 	fs.Var(&c.Xsuffix, "xs", "file name suffix to exclude (multiple -xs okay; default: '~')")
 
+	fs.Var((*metaFlag)(&c.Meta), "meta", "also hash these metadata fields into a separate digest: "+strings.Join(metaFields, ",")+" (comma separated)")
 	fs.BoolVar(&c.ModTimeHash, "mt", false, "include modtime in the hash")
 
 	fs.BoolVar(&c.Hex, "hex", false, "output as hex rather than base64")
+	fs.IntVar(&c.OutLen, "len", 0, fmt.Sprintf("length in bytes of each sum, from 1 to %v (default 33, or 32 with -hex)", MaxSumLen))
+	fs.Int64Var(&c.Seek, "seek", 0, "start each sum this many bytes into the blake3 extended output")
+	fs.StringVar(&c.Context, "context", "", "hash in keyed mode, with the key DeriveKey(context, -key contents) for this context string (like \"acme backups 2026 v1\"); not the same sums as b3sum --derive-key")
+	fs.StringVar(&c.KeyPath, "key", "", "keyed hash (MAC) mode, with the 32 byte key (raw, or 64 hex digits) in this file")
 
 	fs.StringVar(&c.SingleFilePath, "f", "", "just sum this single file, no directory walking.")
 	fs.BoolVar(&c.PathsFirst, "s", false, "sortable, so path names first then hashes in output")
+	fs.StringVar(&c.CheckPath, "c", "", "check: read sums from this file (prior b3 output) and verify them")
+	fs.StringVar(&c.OutPath, "o", "", "write a versioned manifest (header, sums, hash of hashes) atomically to this file, instead of printing")
+	fs.BoolVar(&c.JSON, "json", false, "output a single JSON document")
+	fs.BoolVar(&c.NDJSON, "ndjson", false, "output one JSON record per line as each file is done, then a summary record")
+	fs.IntVar(&c.TreeVersion, "tree", TreeFlat, "hash of hashes format: 0 = sums only; 1 = also commit to relative paths and file types; 2 = Merkle tree of per-directory hashes")
+	fs.BoolVar(&c.DirSums, "dirsums", false, "print the Merkle hash of each directory too (implies -tree 2)")
+	fs.BoolVar(&c.Dirs, "dirs", false, "list every directory walked, empty ones too, and include them in the hash of hashes")
+	fs.StringVar(&c.CachePath, "cache", "", "remember sums in this file; skip rehashing files whose device, inode, size, mtime and ctime are unchanged")
+	fs.BoolVar(&c.Rehash, "rehash", false, "with -cache: rehash every file anyway, and refresh the cache")
+	fs.BoolVar(&c.PruneCache, "prune", false, "with -cache: drop cache entries for files that no longer exist")
+	fs.IntVar(&c.Jobs, "j", 0, "hash with at most this many threads in all, shared between files (default: one per CPU)")
+	fs.IntVar(&c.HDDJobs, "hddjobs", 1, "read at most this many files at once from each spinning disk, in the order they lie on it")
+	fs.BoolVar(&c.NoPageCache, "no-pagecache", false, "read files without updating their atime, and drop the pages read into the page cache once hashed (Linux; one thread per file)")
+	fs.BoolVar(&c.Background, "bg", false, "run in the background: at nice 19, and on Linux, in the idle I/O class")
+	fs.BoolVar(&c.Progress, "progress", false, fmt.Sprintf("report progress on stderr: a status line on a terminal, else a #b3-progress line every %v", progressLineEvery))
+	fs.BoolVar(&c.FailFast, "failfast", false, "stop at the first unreadable file (default: report all unreadable files, then exit non-zero)")
 }
 
 func (cfg *Blake3SummerConfig) FinishConfig(fs *flag.FlagSet) (err error) {
@@ -121,6 +294,86 @@ func (cfg *Blake3SummerConfig) FinishConfig(fs *flag.FlagSet) (err error) {
 	}
 
 	cfg.HasExcludes = len(cfg.Xprefix.x) > 0 || len(cfg.Xsuffix.x) > 0
+
+	switch cfg.TreeVersion {
+	case TreeFlat, TreePaths, TreeMerkle:
+	default:
+		return fmt.Errorf("unknown -tree format %v", cfg.TreeVersion)
+	}
+	n := 0
+	for _, b := range []bool{cfg.JSON, cfg.NDJSON, cfg.OutPath != ""} {
+		if b {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("choose only one of -json, -ndjson, and -o")
+	}
+
+	// "b3 -" is short for "b3 -f -".
+	for _, g := range cfg.Globs {
+		if g != StdinPath {
+			continue
+		}
+		if len(cfg.Globs) > 1 || cfg.SingleFilePath != "" {
+			return fmt.Errorf("- (standard input) must be the only path")
+		}
+		cfg.SingleFilePath, cfg.Globs = StdinPath, nil
+	}
+	if cfg.SingleFilePath == StdinPath {
+		switch {
+		case cfg.PathListStdin:
+			return fmt.Errorf("-i reads paths from standard input, so it cannot be combined with -")
+		case cfg.ModTimeHash:
+			return fmt.Errorf("-mt needs a file; standard input has no modtime")
+		case len(cfg.Meta) > 0:
+			return fmt.Errorf("-meta needs a file; standard input has no metadata")
+		}
+	}
+
+	for _, f := range cfg.Meta {
+		if (f == MetaXattr || f == MetaACL) && !xattrSupported {
+			return fmt.Errorf("-meta %v is not supported on this platform", f)
+		}
+	}
+
+	err = cfg.setIgnorer()
+	if err != nil {
+		return err
+	}
+
+	if cfg.Jobs < 0 || cfg.HDDJobs < 0 {
+		return fmt.Errorf("-j and -hddjobs cannot be negative")
+	}
+	cfg.budget = newCPUBudget(cfg.jobs())
+
+	if cfg.OutLen < 0 || cfg.OutLen > MaxSumLen {
+		return fmt.Errorf("-len must be from 1 to %v", MaxSumLen)
+	}
+	if cfg.Seek < 0 {
+		return fmt.Errorf("-seek cannot be negative")
+	}
+
+	if cfg.KeyPath != "" {
+		cfg.keyMaterial, err = loadKeyFile(cfg.KeyPath)
+		if err != nil {
+			return err
+		}
+	}
+	cfg.initKey()
+
+	if (cfg.Rehash || cfg.PruneCache) && cfg.CachePath == "" {
+		return fmt.Errorf("-rehash and -prune need -cache")
+	}
+
+	if cfg.DirSums {
+		switch cfg.TreeVersion {
+		case TreeFlat:
+			cfg.TreeVersion = TreeMerkle
+		case TreePaths:
+			return fmt.Errorf("-dirsums needs -tree 2, not -tree 1")
+		}
+	}
 	//vv("cfg.HasExcludes = %v", cfg.HasExcludes)
 
 	if len(cfg.Globs) == 0 {
@@ -144,11 +397,52 @@ Flags:
 	os.Exit(1)
 }
 
+// setIgnorer sets up cfg.ignore for NoIgnore and GitIgnore.
+func (cfg *Blake3SummerConfig) setIgnorer() error {
+	cfg.ignore = nil
+	if cfg.NoIgnore {
+		if cfg.GitIgnore || cfg.OnlyIgnored {
+			return fmt.Errorf("-no-ignore cannot be combined with -gitignore or -ignored")
+		}
+		return nil
+	}
+	cfg.ignore = NewIgnorer(B3IgnoreFile)
+	if cfg.GitIgnore {
+		// .b3ignore goes last, so it can override .gitignore.
+		cfg.ignore = NewIgnorer(GitIgnoreFile, B3IgnoreFile)
+		cfg.ignore.SkipGit = true
+	}
+	return nil
+}
+
+// exitUnlessBackground puts the whole process in the
+// background, for b3 -bg, or exits with code on failure.
+// This is for the Mains: FinishConfig only sets up cfg, and
+// leaves the process alone.
+func (cfg *Blake3SummerConfig) exitUnlessBackground(code int) {
+	if !cfg.Background {
+		return
+	}
+	if err := enterBackground(); err != nil {
+		fmt.Fprintf(os.Stderr, "b3 error: -bg: '%s'\n", err)
+		os.Exit(code)
+	}
+}
+
 // b3 calls
 func Main() {
 	//vv("top of main for b3")
 	Exit1IfVersionReq()
 
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		DiffMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dupes" {
+		DupesMain(os.Args[2:])
+		return
+	}
+
 	cfg := &Blake3SummerConfig{}
 	fs := flag.NewFlagSet("b3", flag.ExitOnError)
 	cfg.SetFlags(fs)
@@ -162,6 +456,16 @@ func Main() {
 		fs.PrintDefaults()
 		return
 	}
+	cfg.exitUnlessBackground(1)
+
+	if cfg.CheckPath != "" {
+		_, err = cfg.CheckManifest(cfg.CheckPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	_, err = DirTreeBlake3Hash(cfg)
 	if err != nil {
@@ -182,47 +486,389 @@ type DirTreeHash struct {
 	// TopBlake3 holds the blake3 hash of the SinglePath file, or the hash
 	// of the sorted hashs of PathSums.
 	TopBlake3 string
+
+	// DirSums holds the hash of every directory when
+	// the TreeVersion is TreeMerkle. The root directory
+	// is last, and its Sum is the same as TopBlake3.
+	DirSums []*PathSum
+
+	// Errs holds the paths that could not be checksummed,
+	// each with its Err set. They are not in PathSums,
+	// and do not contribute to TopBlake3.
+	Errs []*PathSum
 }
 
 func DirTreeBlake3Hash(cfg *Blake3SummerConfig) (ret *DirTreeHash, err0 error) {
 
 	ret = &DirTreeHash{}
+	t0 := time.Now()
+
+	finishCache, err0 := cfg.useCache()
+	if err0 != nil {
+		return nil, err0
+	}
+	defer func() {
+		err := finishCache()
+		if err0 == nil {
+			err0 = err
+		}
+	}()
+
+	stopProgress := cfg.startProgress()
+	defer stopProgress()
 
 	//vv("cfg.Globs = '%#v'", cfg.Globs)
 
 	//vv("cfg.Xsuffix = '%#v'", cfg.Xsuffix)
 	//vv("cfg.Xprefix = '%#v'", cfg.Xprefix)
 
-	// path -> blake3 checksum
-	results := make(chan *PathSum, 100000)
-
-	fileMap := make(map[string]bool)
-	var paths []string
-
 	if cfg.SingleFilePath != "" {
-		t0 := time.Now()
-		sum, err := cfg.Blake3OfFile(cfg.SingleFilePath)
+		one := &PathSum{Path: cfg.SingleFilePath, Type: TypeFile}
+		var err error
+		if cfg.SingleFilePath == StdinPath {
+			cfg.progress.foundFile(0)
+		} else if fi, err := os.Lstat(cfg.SingleFilePath); err == nil {
+			cfg.progress.foundFile(fi.Size())
+		}
+		cfg.progress.walkDone()
+		cfg.progress.begin(cfg.SingleFilePath)
+		if cfg.SingleFilePath == StdinPath {
+			one.Sum, one.Size, err = cfg.sumReader(os.Stdin)
+		} else {
+			var fi os.FileInfo
+			one.Sum, fi, err = cfg.sumFile(cfg.SingleFilePath)
+			if err == nil && len(cfg.Meta) > 0 {
+				one.Meta, err = cfg.metaDigest(cfg.SingleFilePath, fi)
+			}
+			if err == nil {
+				one.Type = fileType(fi)
+				one.Size = fi.Size()
+				one.ModTime = fi.ModTime()
+			}
+		}
 		elap := time.Since(t0)
+		one.Err = err
+		cfg.progress.end(one)
 		if err != nil {
 			return nil, fmt.Errorf("b3 error on path '%v': %v\n", cfg.SingleFilePath, err)
 		}
+		one.Elap = elap
+		sum := one.Sum
+		ret.SinglePath = cfg.SingleFilePath
+		ret.TopBlake3 = sum
+		ret.PathSums = []*PathSum{one}
+		switch {
+		case cfg.OutPath != "":
+			return ret, cfg.WriteManifestFile(cfg.OutPath, ret.PathSums, sum)
+		case cfg.JSON:
+			return ret, cfg.WriteJSON(os.Stdout, ret, ret.PathSums, elap)
+		case cfg.NDJSON:
+			enc := json.NewEncoder(os.Stdout)
+			enc.Encode(newJSONRecord(ret.PathSums[0]))
+			return ret, enc.Encode(cfg.newJSONSummary(ret, elap))
+		}
 		if !cfg.Quiet {
-			if cfg.PathsFirst {
-				fmt.Printf("%v   %v\n", cfg.SingleFilePath, sum)
-			} else {
-				fmt.Printf("%v   %v\n", sum, cfg.SingleFilePath)
-			}
+			cfg.printHeader()
+			cfg.printLine(cfg.SingleFilePath, sumField(one))
 
-			fi, err := os.Stat(cfg.SingleFilePath)
-			panicOn(err)
-			sz := float64(fi.Size()) / (1 << 20) // in MB/sec
+			sz := float64(one.Size) / (1 << 20) // in MB/sec
 			fmt.Printf("%0.3f MB.  elap = %v. rate =   %0.6f  MB/sec\n", sz, elap, sz/(float64(elap)/1e9))
 		}
-		ret.SinglePath = cfg.SingleFilePath
-		ret.TopBlake3 = sum
 		return
 	}
 
+	// -ndjson streams each result as soon as we have it.
+	var each func(s *PathSum)
+	var ndjson *json.Encoder
+	if cfg.NDJSON {
+		ndjson = json.NewEncoder(os.Stdout)
+		each = func(s *PathSum) {
+			if s.Type == TypeDir {
+				// not summed yet; these go out below.
+				return
+			}
+			ndjson.Encode(newJSONRecord(s))
+		}
+	}
+
+	// the plain listing is printed as the files are done, in
+	// sorted order, when the walk can find them in that order.
+	var inOrder func(s *PathSum)
+	if cfg.streamListing() {
+		cfg.sortedWalk = true
+		defer func() { cfg.sortedWalk = false }()
+		cfg.printHeader()
+		inOrder = func(s *PathSum) {
+			if s.Err == nil {
+				cfg.progress.above(func() { cfg.printSum(s) })
+			}
+		}
+	}
+
+	sums, errs, err := cfg.hashWalk(cfg.walkTargets, each, inOrder)
+	ret.Errs = errs
+	if err != nil {
+		if len(errs) > 0 {
+			// -failfast
+			return ret, err
+		}
+		return nil, err
+	}
+
+	// report in lexicographic order (as inOrder had them already).
+	sort.Sort(sums)
+	if cfg.Dirs {
+		cfg.sumDirEntries(sums)
+	}
+
+	ret.PathSums = sums
+
+	// over-all hash of hashes
+	var allsum string
+	if cfg.TreeVersion == TreeMerkle {
+		allsum, ret.DirSums = cfg.MerkleTree(sums, cfg.treeRoot())
+	} else {
+		allsum = cfg.TreeHash(sums, cfg.treeRoot())
+	}
+	ret.TopBlake3 = allsum
+
+	listing := sums
+	if cfg.DirSums && len(ret.DirSums) > 1 {
+		// directories sort just before their contents. The
+		// root's hash is the hash of hashes, printed below.
+		listing = append(append(pathsumSlice{}, sums...), ret.DirSums[:len(ret.DirSums)-1]...)
+		sort.Sort(listing)
+	}
+	switch {
+	case cfg.OutPath != "":
+		err0 = cfg.WriteManifestFile(cfg.OutPath, listing, allsum)
+		if err0 != nil {
+			return
+		}
+	case cfg.JSON:
+		err0 = cfg.WriteJSON(os.Stdout, ret, listing, time.Since(t0))
+		if err0 != nil {
+			return
+		}
+	case cfg.NDJSON:
+		// the files went out as they were hashed.
+		if cfg.Dirs {
+			for _, s := range sums {
+				if s.Type == TypeDir {
+					ndjson.Encode(newJSONRecord(s))
+				}
+			}
+		}
+		if cfg.DirSums {
+			for _, s := range ret.DirSums {
+				ndjson.Encode(newJSONRecord(s))
+			}
+		}
+		ndjson.Encode(cfg.newJSONSummary(ret, time.Since(t0)))
+	case inOrder != nil:
+		// the files went out as they were hashed.
+		cfg.printTop(listing, allsum)
+	default:
+		cfg.printListing(listing, allsum)
+	}
+	if len(ret.Errs) > 0 {
+		err0 = fmt.Errorf("b3 error: %v file(s) could not be checksummed", len(ret.Errs))
+	}
+	return
+}
+
+// printListing prints the sums for people to read,
+// then the hash of hashes.
+func (cfg *Blake3SummerConfig) printListing(listing []*PathSum, allsum string) {
+	if !cfg.Quiet {
+		cfg.printHeader()
+	}
+	for _, s := range listing {
+		cfg.printSum(s)
+	}
+	cfg.printTop(listing, allsum)
+}
+
+// printSum prints one line of the listing.
+func (cfg *Blake3SummerConfig) printSum(s *PathSum) {
+	if !cfg.Quiet {
+		cfg.printLine(s.Path, sumField(s))
+	}
+}
+
+// printLine prints "sum   path", or "path   sum" with b3 -s.
+// A path with a newline or a backslash in it is escaped, and
+// the line marked, as in a manifest, so b3 -c reads it back.
+func (cfg *Blake3SummerConfig) printLine(path, sum string) {
+	path, escaped := escapeManifestPath(path)
+	mark := ""
+	if escaped {
+		mark = `\`
+	}
+	if cfg.PathsFirst {
+		fmt.Printf("%v%v   %v\n", mark, path, sum)
+	} else {
+		fmt.Printf("%v%v   %v\n", mark, sum, path)
+	}
+}
+
+// printTop ends the listing with the hash of hashes.
+func (cfg *Blake3SummerConfig) printTop(listing []*PathSum, allsum string) {
+	if !cfg.Quiet {
+		if len(listing) > 1 {
+			fmt.Printf("%v   [hash of hashes; checksum of above]\n", allsum)
+		}
+	}
+}
+
+// streamListing reports if the plain listing can be printed
+// as the files are done, rather than once they all are. The
+// other outputs need the whole scan first: the manifest, the
+// JSON document, the directory sums and entries (which sort
+// before what is under them), and -failfast (which prints
+// no listing if it stops). -ndjson streams already.
+func (cfg *Blake3SummerConfig) streamListing() bool {
+	return !cfg.Quiet && cfg.OutPath == "" && !cfg.JSON && !cfg.NDJSON &&
+		!cfg.DirSums && !cfg.Dirs && !cfg.FailFast && cfg.walkInOrder()
+}
+
+// walkInOrder reports if walkTargets can find the paths in
+// sorted order, given cfg.sortedWalk. Paths listed on stdin
+// (-i) come in the order given, and followed symlinks lead
+// anywhere. When one target directory lies inside another,
+// what is found under the inner one would come after all
+// of the outer one; and paths under "/" come out as "//x"
+// for the top level, but "/x/y" below it.
+func (cfg *Blake3SummerConfig) walkInOrder() bool {
+	if cfg.PathListStdin || cfg.FollowSymLinks {
+		return false
+	}
+	var dirs []string
+	for _, g := range cfg.Globs {
+		dirs = append(dirs, filepath.Dir(g))
+	}
+	for _, d1 := range dirs {
+		if d1 == "/" {
+			return false
+		}
+		for _, d2 := range dirs {
+			switch {
+			case d1 == d2:
+			case d1 == ".":
+				if !filepath.IsAbs(d2) && d2 != ".." && !strings.HasPrefix(d2, "../") {
+					return false
+				}
+			case strings.HasPrefix(d2, d1+"/"):
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hashWalk checksums every file that walk finds. Walking,
+// hashing, and collecting all run concurrently, connected by
+// small buffered channels and per-device queues holding at
+// most maxQueued paths in all, so memory use in the pipeline
+// stays bounded no matter how many files we find. Files that could
+// not be checksummed are reported on stderr and returned in errs.
+// With cfg.FailFast we stop at the first of them, with err set.
+// If each is not nil, it is called with every result (including
+// the errors) as it arrives, in no particular order. If inOrder
+// is not nil, it is called with every result too, but in the
+// order walk found their paths, through a reorderBuffer; sums
+// are then collected in that order as well.
+func (cfg *Blake3SummerConfig) hashWalk(walk func(add func(path string)) error, each, inOrder func(s *PathSum)) (sums pathsumSlice, errs []*PathSum, err error) {
+
+	paths := make(chan string, 1024)
+	results := make(chan *PathSum, 1024)
+	feed := newPathFeed(paths)
+
+	var reorder *reorderBuffer
+	if inOrder != nil {
+		reorder = newReorderBuffer(func(s *PathSum) {
+			inOrder(s)
+			if s.Err == nil {
+				sums = append(sums, s)
+			}
+		})
+	}
+	if cfg.progress != nil || reorder != nil {
+		feed.found = func(path string) {
+			if cfg.progress != nil {
+				var size int64
+				if cfg.Progress {
+					// the sizes make for a better ETA.
+					if fi, err := os.Lstat(path); err == nil {
+						size = fi.Size()
+					}
+				}
+				cfg.progress.foundFile(size)
+			}
+			if reorder != nil {
+				reorder.add(path)
+			}
+		}
+	}
+
+	var walkErr error
+	go func() {
+		defer close(paths)
+		walkErr = walk(feed.add)
+		cfg.progress.walkDone()
+	}()
+
+	// checksum the files in parallel, as they are found.
+	go cfg.ScanPaths(paths, results)
+
+	for sum := range results {
+		if each != nil {
+			each(sum)
+		}
+		if reorder != nil {
+			reorder.finished(sum)
+		}
+		if sum.Err != nil {
+			cfg.progress.above(func() {
+				fmt.Fprintf(os.Stderr, "b3 error on path '%v': %v\n", sum.Path, sum.Err)
+			})
+			errs = append(errs, sum)
+			if cfg.FailFast {
+				// stop feeding the workers, and let the
+				// rest of the pipeline drain in the background.
+				feed.halt()
+				if reorder != nil {
+					reorder.out = nil
+				}
+				go func() {
+					for sum := range results {
+						if reorder != nil {
+							reorder.finished(sum)
+						}
+					}
+				}()
+				return nil, errs, fmt.Errorf("b3 error: stopping at first unreadable file (-failfast)")
+			}
+			continue
+		}
+		if reorder == nil {
+			sums = append(sums, sum)
+		}
+	}
+	// results is closed only after paths is closed, so walkErr is set.
+	if walkErr != nil {
+		return nil, errs, walkErr
+	}
+	return
+}
+
+// walkTargets finds the files to checksum, either from the
+// path list on stdin (-i) or from cfg.Globs, and passes each
+// one to add as soon as it is found.
+func (cfg *Blake3SummerConfig) walkTargets(add func(path string)) error {
+
+	var paths []string
+
 	if cfg.PathListStdin {
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
@@ -231,18 +877,25 @@ func DirTreeBlake3Hash(cfg *Blake3SummerConfig) (ret *DirTreeHash, err0 error) {
 
 			fi, err := os.Stat(line)
 			if err != nil {
+				// let the hashing stage report it, unless
+				// it is a symlink that we can checksum.
+				add(line)
 				continue
 			}
-			if !fi.IsDir() {
-				if cfg.HasExcludes && cfg.shouldExclude(line) {
+			if fi.IsDir() {
+				if cfg.Dirs && cfg.Filters.keep(line) {
+					add(strings.TrimSuffix(line, "/") + "/")
+				}
+			} else {
+				if (cfg.HasExcludes && cfg.shouldExclude(line)) || !cfg.Filters.keep(line) {
 					//vv("skipping line '%v'", line)
 				} else {
-					fileMap[line] = true
+					add(line)
 				}
 			}
 		}
 		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("b3 error reading standard input: %v\n", err)
+			return fmt.Errorf("b3 error reading standard input: %v\n", err)
 		}
 
 	} else {
@@ -257,6 +910,22 @@ func DirTreeBlake3Hash(cfg *Blake3SummerConfig) (ret *DirTreeHash, err0 error) {
 
 		// get dirs; all of them so we look for our pattern below the cwd.
 
+		if cfg.ignore != nil {
+			// no ignore files above the directories we list
+			// apply; shallowest first, so those nested in
+			// another are walked as part of it.
+			var roots []string
+			for _, g := range cfg.Globs {
+				roots = append(roots, filepath.Dir(g))
+			}
+			sort.Slice(roots, func(i, j int) bool {
+				return len(roots[i]) < len(roots[j])
+			})
+			for _, d := range roots {
+				cfg.ignore.AddRoot(d)
+			}
+		}
+
 		for _, g := range cfg.Globs {
 			d := filepath.Dir(g)
 			//vv("d = '%v'", d)
@@ -272,6 +941,9 @@ func DirTreeBlake3Hash(cfg *Blake3SummerConfig) (ret *DirTreeHash, err0 error) {
 						continue
 					}
 				}
+				if cfg.HasExcludes && cfg.excludedName(entry.Name()) {
+					continue
+				}
 				if entry.IsDir() {
 					dirs = append(dirs, pre+entry.Name())
 				} else {
@@ -280,13 +952,19 @@ func DirTreeBlake3Hash(cfg *Blake3SummerConfig) (ret *DirTreeHash, err0 error) {
 			}
 		}
 
+		// what to walk: the files, then the directories. With
+		// cfg.sortedWalk, all of them in sorted order instead,
+		// a directory sorting as its path with a "/" after it,
+		// as everything found under it will.
+		var tops []walkTop
+
 		for _, path := range paths {
 			//vv("path = '%v'", path)
 			//fi, err := os.Stat(path) // symlink dangling targets -> error
 			fi, err := os.Lstat(path)
 			if err != nil {
 
-				return nil, fmt.Errorf("b3 error on Lstat of target path '%v': '%v'\n", path, err)
+				return fmt.Errorf("b3 error on Lstat of target path '%v': '%v'\n", path, err)
 			}
 			//isSymlink := fi.Mode()&os.ModeSymlink != 0
 
@@ -325,66 +1003,72 @@ func DirTreeBlake3Hash(cfg *Blake3SummerConfig) (ret *DirTreeHash, err0 error) {
 					dirs = append(dirs, path)
 				}
 			} else {
-				if cfg.keep(path) {
-					fileMap[path] = true
+				if cfg.keep(path) && cfg.keepIgnored(path) {
+					tops = append(tops, walkTop{path: path, key: path})
 				}
 			}
 		}
 		//vv("dirs = '%#v'", dirs)
 
-		// fill in the fileMap with all files in a recursive directory walk
-		cfg.WalkDirs(dirs, fileMap)
-
-	}
-	// don't scan ..
-	delete(fileMap, "..")
-	delete(fileMap, ".")
-
-	// checksum the files in parallel.
-	cfg.ScanFiles(fileMap, results)
-
-	var sums pathsumSlice // []*PathSum
-	for sum := range results {
-		sums = append(sums, sum)
-	}
-
-	// over-all hash of hashes
-	hoh := blake3.New(64, nil)
-
-	// report in lexicographic order
-	sort.Sort(sums)
-
-	ret.PathSums = sums
-
-	for _, s := range sums {
-		if !cfg.Quiet {
-			if cfg.PathsFirst {
-				fmt.Printf("%v   %v\n", s.Path, s.Sum)
+		// feed in all files from a recursive directory walk
+		dirs, ignoredDirs := cfg.splitIgnoredDirs(dirs)
+		for _, dir := range dirs {
+			tops = append(tops, walkTop{path: dir, key: dir + "/", cfg: cfg})
+		}
+		if len(ignoredDirs) > 0 {
+			// with -ignored: everything in them is ignored.
+			c2 := *cfg
+			c2.ignore = nil
+			for _, dir := range ignoredDirs {
+				tops = append(tops, walkTop{path: dir, key: dir + "/", cfg: &c2})
+			}
+		}
+		if cfg.sortedWalk {
+			sort.SliceStable(tops, func(i, j int) bool {
+				return tops[i].key < tops[j].key
+			})
+		}
+		for _, t := range tops {
+			if t.cfg == nil {
+				add(t.path)
 			} else {
-				fmt.Printf("%v   %v\n", s.Sum, s.Path)
+				t.cfg.scanOneDir(t.path, add)
 			}
 		}
-		hoh.Write([]byte(s.Sum))
-	}
 
-	by := hoh.Sum(nil)
-	allsum := "blake3.33B-" + cristalbase64.URLEncoding.EncodeToString(by[:33])
-	if cfg.Hex {
-		allsum = fmt.Sprintf("%x", by[:32])
 	}
-	ret.TopBlake3 = allsum
+	return nil
+}
 
-	if !cfg.Quiet {
-		if len(sums) > 1 {
-			fmt.Printf("%v   [hash of hashes; checksum of above]\n", allsum)
-		}
-	}
-	return
+// walkTop is a file or directory that walkTargets starts
+// from. Directories are walked with their cfg; files have none.
+type walkTop struct {
+	path string
+	key  string
+	cfg  *Blake3SummerConfig
 }
 
 type PathSum struct {
 	Path string
 	Sum  string
+
+	// Meta is the metadata digest, with -meta.
+	Meta string
+
+	// Type is TypeFile or TypeSymlink, or TypeDir
+	// for the directory hashes in DirTreeHash.DirSums.
+	Type string
+
+	// Size and ModTime are from Lstat of Path.
+	Size    int64
+	ModTime time.Time
+
+	// Elap is how long it took to checksum Path.
+	Elap time.Duration
+
+	// Err is set, and Sum is empty, if Path
+	// could not be checksummed.
+	Err error
 }
 
 type pathsumSlice []*PathSum
@@ -395,16 +1079,62 @@ func (p pathsumSlice) Less(i, j int) bool {
 }
 func (p pathsumSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
+// Blake3OfReader checksums everything read from r, until
+// io.EOF, and encodes the sum just as Blake3OfFile does,
+// with the same -hex, -len, -seek, -key and -context
+// options. There is no modtime to add for -mt.
+func (cfg *Blake3SummerConfig) Blake3OfReader(r io.Reader) (blake3sum string, err error) {
+	blake3sum, _, err = cfg.sumReader(r)
+	return
+}
+
+// sumReader does the work of Blake3OfReader, and
+// also returns the number of bytes read.
+func (cfg *Blake3SummerConfig) sumReader(r io.Reader) (blake3sum string, n int64, err error) {
+	if cfg.progress != nil {
+		r = &progressReader{r: r, p: cfg.progress}
+	}
+	h := cfg.newHasher()
+	n, err = io.Copy(h, r)
+	if err != nil {
+		return "", n, err
+	}
+	return cfg.encodeSum(h), n, nil
+}
+
 func (cfg *Blake3SummerConfig) Blake3OfFile(path string) (blake3sum string, err error) {
+	blake3sum, _, err = cfg.sumFile(path)
+	return
+}
+
+// sumFile does the work of Blake3OfFile, and also returns
+// the Lstat info for path, so callers do not need to stat again.
+func (cfg *Blake3SummerConfig) sumFile(path string) (blake3sum string, fi os.FileInfo, err error) {
 
-	var sum []byte
 	var h *blake3.Hasher
 
 	done := false
-	fi, err := os.Lstat(path)
-	panicOn(err)
+	fi, err = os.Lstat(path)
+	if err != nil {
+		return "", nil, err
+	}
 	isSymlink := fi.Mode()&os.ModeSymlink != 0
 
+	if cfg.cache != nil && !isSymlink {
+		params := cfg.sumParams()
+		if !cfg.Rehash {
+			if sum, ok := cfg.cache.get(path, fi, params); ok {
+				return sum, fi, nil
+			}
+		}
+		t0 := time.Now()
+		defer func() {
+			if err == nil {
+				cfg.cache.put(path, fi, params, blake3sum, t0)
+			}
+		}()
+	}
+
 	// Symlinks that dangle or not make a mess
 	// of our hashing and comparing directories.
 	// We need a consistent approach to verify
@@ -418,11 +1148,10 @@ func (cfg *Blake3SummerConfig) Blake3OfFile(path string) (blake3sum string, err
 		// This verifies that a link got synced correctly.
 		target, err := os.Readlink(path)
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
-		h = blake3.New(64, nil)
+		h = cfg.newHasher()
 		h.Write([]byte(target))
-		sum = h.Sum(nil)
 
 		if cfg.ModTimeHash {
 			modTime := fi.ModTime()
@@ -436,68 +1165,203 @@ func (cfg *Blake3SummerConfig) Blake3OfFile(path string) (blake3sum string, err
 			s := fmt.Sprintf("%v",
 				modTime.UTC().Format(fRFC3339NanoNumericTZ0pad))
 			h.Write([]byte(s))
-			sum = h.Sum(nil)
 		}
 	}
 	if !done {
 
-		// use the new HashFile() facility.
-		sum, h, err = blake3.HashFile(path)
+		// use the new HashFile() facility; HashFile2
+		// so that we can give it our key, if any, and
+		// our share of the threads. sumUncached reads
+		// with just the one.
+		threads := 0
+		if cfg.budget != nil {
+			size := fi.Size()
+			if cfg.NoPageCache {
+				size = 0
+			}
+			threads = cfg.budget.acquire(size)
+			defer cfg.budget.release(threads)
+		}
+		if cfg.NoPageCache {
+			h, err = cfg.sumUncached(path)
+		} else {
+			_, h, err = blake3.HashFile2(path, cfg.key, 0, threads)
+		}
 		if err != nil {
 			//vv("blake3.HashFile gave error: '%v'", err) // no such file
-			return "", err
+			return "", nil, err
 		}
 
 		if cfg.ModTimeHash {
 			fi, err := os.Stat(path)
 			if err != nil {
-				return "", err
+				return "", nil, err
 			}
 			// put into a canonical format.
 			s := fmt.Sprintf("%v", fi.ModTime().UTC().Format(fRFC3339NanoNumericTZ0pad))
 			h.Write([]byte(s))
-			sum = h.Sum(nil)
 		}
 	}
+	blake3sum = cfg.encodeSum(h)
+	return
+}
+
+// useCache loads the hash cache from cfg.CachePath, if one
+// was requested and it is not loaded yet. The returned finish
+// func prunes it (with -prune) and saves it; call it when done.
+func (cfg *Blake3SummerConfig) useCache() (finish func() error, err error) {
+	if cfg.CachePath == "" || cfg.cache != nil {
+		return func() error { return nil }, nil
+	}
+	cfg.cache, err = loadHashCache(cfg.CachePath)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		if cfg.PruneCache {
+			cfg.cache.prune()
+		}
+		return cfg.cache.save()
+	}, nil
+}
+
+// sumParams describes the options that change the sum
+// of a file's contents, so that cached sums are only
+// reused under the same options.
+func (cfg *Blake3SummerConfig) sumParams() string {
+	return fmt.Sprintf("mt=%v hex=%v key=%v context=%q len=%v seek=%v",
+		cfg.ModTimeHash, cfg.Hex, cfg.keyID(), cfg.Context, cfg.sumLen(), cfg.Seek)
+}
+
+// sumLen is how many bytes of blake3 output go into each
+// sum: cfg.OutLen, or by default 33 (32 with -hex).
+func (cfg *Blake3SummerConfig) sumLen() int {
+	switch {
+	case cfg.OutLen > 0:
+		return cfg.OutLen
+	case cfg.Hex:
+		return 32
+	}
+	return 33
+}
+
+// sumBytes reads the sumLen() bytes of output from h,
+// starting cfg.Seek bytes into its extended output (XOF).
+// The first 64 bytes are just h.Sum(); BLAKE3 can keep
+// going from there as long as we like.
+func (cfg *Blake3SummerConfig) sumBytes(h *blake3.Hasher) []byte {
+	n := cfg.sumLen()
+	if cfg.Seek == 0 && n <= 64 {
+		return h.Sum(nil)[:n]
+	}
+	xof := h.XOF()
+
+	// OutputReader.Seek only lands correctly on a multiple
+	// of its 1KB block buffer (16 blocks of 64 bytes), so
+	// seek to the one before, then read up to cfg.Seek.
+	const xofBuf = 1024
+	aligned := cfg.Seek - cfg.Seek%xofBuf
+	_, err := xof.Seek(aligned, io.SeekStart)
+	panicOn(err)
+	_, err = io.CopyN(io.Discard, xof, cfg.Seek-aligned)
+	panicOn(err)
+	out := make([]byte, n)
+	_, err = io.ReadFull(xof, out)
+	panicOn(err)
+	return out
+}
+
+// lenLabel is the part of a label after the keying: the
+// sum length in bytes, any -seek offset, and ".hex" with
+// -hex. For example ".33B-", ".8B@64-", or ".32B.hex-".
+// The default hex length is just ".hex-".
+func (cfg *Blake3SummerConfig) lenLabel() string {
+	n := cfg.sumLen()
+	at := ""
+	if cfg.Seek > 0 {
+		at = fmt.Sprintf("@%v", cfg.Seek)
+	}
+	if cfg.Hex {
+		if n == 32 && at == "" {
+			return ".hex-"
+		}
+		return fmt.Sprintf(".%vB%v.hex-", n, at)
+	}
+	return fmt.Sprintf(".%vB%v-", n, at)
+}
+
+// sumLabel is the prefix encodeSum puts on each sum:
+// "blake3", then the keying, then the lenLabel. Sums made
+// with -key are labeled "blake3k.", and with -context
+// "blake3d.", so that they can never be mistaken for (or
+// compared against) unkeyed sums; see keying. Plain -hex
+// sums of the default length have no label at all.
+func (cfg *Blake3SummerConfig) sumLabel() string {
+	label := "blake3" + cfg.keying() + cfg.lenLabel()
+	if label == "blake3.hex-" {
+		return ""
+	}
+	return label
+}
+
+// encodeSum formats the sum in h the way b3 prints it: by
+// default the first 33 bytes in base64 after the "blake3.33B-"
+// label, or the first 32 bytes in plain hex with -hex.
+// See sumLabel and sumBytes for the other options.
+func (cfg *Blake3SummerConfig) encodeSum(h *blake3.Hasher) string {
+	return cfg.sumLabel() + cfg.encodeBytes(cfg.sumBytes(h))
+}
+
+// encodeBytes is hex with -hex, else URL-safe base64.
+func (cfg *Blake3SummerConfig) encodeBytes(sum []byte) string {
 	if cfg.Hex {
-		blake3sum = fmt.Sprintf("%x", sum[:32])
-	} else {
-		blake3sum = "blake3.33B-" + cristalbase64.URLEncoding.EncodeToString(sum[:33])
+		return fmt.Sprintf("%x", sum)
 	}
-	return
+	return cristalbase64.URLEncoding.EncodeToString(sum)
 }
 
+// shouldExclude reports if any component of path, as
+// given, has an excluded prefix (-x) or suffix (-xs).
+// So with the default -x _, both "_build" and
+// "_build/sub/file.go" are excluded.
 func (cfg *Blake3SummerConfig) shouldExclude(path string) bool {
-	base := filepath.Base(path)
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		if cfg.excludedName(name) {
+			return true
+		}
+	}
+	return false
+}
 
+// excludedName reports if the single file or directory
+// name has an excluded prefix (-x) or suffix (-xs).
+func (cfg *Blake3SummerConfig) excludedName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
 	for _, xpre := range cfg.Xprefix.x {
-		if strings.HasPrefix(base, xpre) {
+		if strings.HasPrefix(name, xpre) {
 			return true
 		}
 	}
 	for _, xsuf := range cfg.Xsuffix.x {
-		if strings.HasSuffix(base, xsuf) {
+		if strings.HasSuffix(name, xsuf) {
 			return true
 		}
 	}
-	if path != base {
-		for _, xpre := range cfg.Xprefix.x {
-			if strings.HasPrefix(path, xpre) {
-				return true
-			}
-		}
-		for _, xsuf := range cfg.Xsuffix.x {
-			if strings.HasSuffix(path, xsuf) {
-				return true
-			}
-		}
-	}
 	return false
 }
 
+// keep reports if path, found in a walk, should be checksummed.
+// Only its final name is checked against the -x and -xs
+// excludes: the walk has already pruned excluded directories
+// below the targets named on the command line.
 func (cfg *Blake3SummerConfig) keep(path string) bool {
 
-	if cfg.HasExcludes && cfg.shouldExclude(path) {
+	if cfg.HasExcludes && cfg.excludedName(filepath.Base(path)) {
+		return false
+	}
+	if !cfg.Filters.keep(path) {
 		return false
 	}
 	for _, glob := range cfg.Globs {
@@ -511,6 +1375,86 @@ func (cfg *Blake3SummerConfig) keep(path string) bool {
 	return false
 }
 
+// keepIgnored reports if the top level file at path should
+// be checksummed, given the ignore files and -ignored. The
+// directory walk takes care of the files below.
+func (cfg *Blake3SummerConfig) keepIgnored(path string) bool {
+	if cfg.ignore == nil {
+		return true
+	}
+	return cfg.ignore.Ignored(path, false) == cfg.OnlyIgnored
+}
+
+// splitIgnoredDirs separates the top level dirs that the
+// ignore files leave out. Normally those are dropped; with
+// -ignored they are returned in ignored, to be walked in
+// full, while the rest are walked for ignored files.
+func (cfg *Blake3SummerConfig) splitIgnoredDirs(dirs []string) (walk, ignored []string) {
+	if cfg.ignore == nil {
+		return dirs, nil
+	}
+	for _, dir := range dirs {
+		switch {
+		case cfg.ignore.SkipGit && filepath.Base(dir) == ".git":
+		case !cfg.ignore.Ignored(dir, true):
+			walk = append(walk, dir)
+		case cfg.OnlyIgnored:
+			ignored = append(ignored, dir)
+		}
+	}
+	return
+}
+
+// pathFeed hands paths found by the walk off to the
+// hashing workers as soon as they are found, dropping
+// any duplicates (from overlapping globs, or from
+// following symlinks). The seen set is no larger than
+// the PathSums we collect anyway.
+type pathFeed struct {
+	seen map[string]bool
+	out  chan<- string
+
+	// found, if set, is called with each new path.
+	found func(path string)
+
+	haltOnce sync.Once
+	halted   chan struct{}
+}
+
+func newPathFeed(out chan<- string) *pathFeed {
+	return &pathFeed{
+		seen:   make(map[string]bool),
+		out:    out,
+		halted: make(chan struct{}),
+	}
+}
+
+func (f *pathFeed) add(path string) {
+	// don't scan ..
+	if path == "." || path == ".." || f.seen[path] {
+		return
+	}
+	select {
+	case <-f.halted:
+		return
+	default:
+	}
+	f.seen[path] = true
+	if f.found != nil {
+		f.found(path)
+	}
+	select {
+	case f.out <- path:
+	case <-f.halted:
+	}
+}
+
+// halt makes all future add calls no-ops. The walk
+// still runs to completion, but nothing more is hashed.
+func (f *pathFeed) halt() {
+	f.haltOnce.Do(func() { close(f.halted) })
+}
+
 func (cfg *Blake3SummerConfig) WalkDirs(dirs []string, files map[string]bool) {
 
 	for _, dir := range dirs {
@@ -519,13 +1463,45 @@ func (cfg *Blake3SummerConfig) WalkDirs(dirs []string, files map[string]bool) {
 	return
 }
 
+// ScanOneDir puts every path to be checksummed under
+// root in files. See scanOneDir, which it wraps.
 func (cfg *Blake3SummerConfig) ScanOneDir(root string, files map[string]bool) {
+	cfg.scanOneDir(root, func(path string) {
+		files[path] = true
+	})
+}
+
+// scanOneDir calls add for every path to be checksummed
+// under root, as the walk finds it.
+func (cfg *Blake3SummerConfig) scanOneDir(root string, add func(path string)) {
 	//vv("ScanOneDir root='%v'", root)
 	if !dirExists(root) {
 		return
 	}
+	if cfg.ignore != nil {
+		cfg.ignore.AddRoot(root)
+	}
 	di := NewDirIter()
 	di.FollowSymlinks = cfg.FollowSymLinks
+	di.Ignore = cfg.ignore
+	di.OnlyIgnored = cfg.OnlyIgnored
+	di.Sorted = cfg.sortedWalk
+	if cfg.HasExcludes {
+		// excluded subtrees are never read at all.
+		di.SkipDir = func(dir string) bool {
+			return cfg.excludedName(filepath.Base(dir))
+		}
+	}
+	if cfg.Dirs {
+		di.VisitDir = func(dir string) {
+			// the current directory has no name of its
+			// own to list. The rest are chosen by the
+			// same rules (and targets) as the files.
+			if dir != "." && cfg.keep(dir) {
+				add(dir + "/")
+			}
+		}
+	}
 	next, stop := iter.Pull2(di.FilesOnly(root))
 	defer stop()
 
@@ -535,15 +1511,15 @@ func (cfg *Blake3SummerConfig) ScanOneDir(root string, files map[string]bool) {
 			break
 		}
 		if !ok {
-			break
+			// path is a directory we could not read. Pass
+			// it along so the hashing stage reports the error,
+			// rather than silently dropping everything under it.
+			add(path)
+			continue
 		}
-		if cfg.HasExcludes && cfg.shouldExclude(path) {
-
-		} else {
-			// process globs / patterns
-			if cfg.keep(path) {
-				files[path] = true
-			}
+		// process excludes, globs / patterns
+		if cfg.keep(path) {
+			add(path)
 		}
 	}
 }
@@ -584,41 +1560,79 @@ func (cfg *Blake3SummerConfig) oldScanOneDir(root string, files map[string]bool)
 	panicOn(err)
 }
 
+// ScanFiles checksums files in the background and
+// returns immediately. A *PathSum for each file is sent
+// on results, which is closed once all files are done.
+// The caller should drain results concurrently; it need
+// not be large enough to hold every result.
 func (cfg *Blake3SummerConfig) ScanFiles(files map[string]bool, results chan *PathSum) {
-	var wg sync.WaitGroup
-	wg.Add(len(files))
-
-	ngoro := runtime.NumCPU()
 
 	work := make(chan string, 1024)
-	for i := 0; i < ngoro; i++ {
-		go func() {
-			for path := range work {
-				err := cfg.ScanOneFile(path, results)
-				wg.Done()
-				if err != nil {
-					alwaysPrintf("error on path '%v': '%v'", path, err)
-				}
-			}
-		}()
-	}
+	go func() {
+		defer close(work)
+		for path := range files {
+			work <- path
+		}
+	}()
+	go cfg.ScanPaths(work, results)
+}
 
-	for path := range files {
-		work <- path
+// ScanPaths checksums each path received on paths, and sends
+// a *PathSum for each on results. Each device (st_dev) gets
+// its own workers: cfg.jobs() of them, or on a spinning disk,
+// cfg.hddJobs(), reading the files in the order they lie on
+// the disk; see deviceScheduler. It returns after paths has
+// been closed and every path is done, closing results on the
+// way out.
+func (cfg *Blake3SummerConfig) ScanPaths(paths <-chan string, results chan<- *PathSum) {
+	sched := cfg.newDeviceScheduler(results)
+	for path := range paths {
+		sched.add(path)
 	}
-	wg.Wait()
+	sched.wait()
 	close(results)
 }
 
-func (cfg *Blake3SummerConfig) ScanOneFile(path string, results chan *PathSum) (err error) {
+func (cfg *Blake3SummerConfig) ScanOneFile(path string, results chan<- *PathSum) (err error) {
+
+	cfg.progress.begin(path)
+	s := cfg.scanOne(path)
+	cfg.progress.end(s)
+	results <- s
+	return s.Err
+}
+
+// scanOne checksums path for ScanOneFile.
+func (cfg *Blake3SummerConfig) scanOne(path string) *PathSum {
 
-	sum, err := cfg.Blake3OfFile(path)
+	t0 := time.Now()
+	if cfg.Dirs && strings.HasSuffix(path, "/") {
+		// a directory entry; sumDirEntries gives it a
+		// Sum once everything under it is known.
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return &PathSum{Path: path, Err: err, Elap: time.Since(t0)}
+		}
+		return &PathSum{Path: path, Type: TypeDir, ModTime: fi.ModTime(), Elap: time.Since(t0)}
+	}
+	sum, fi, err := cfg.sumFile(path)
+	var meta string
+	if err == nil && len(cfg.Meta) > 0 {
+		meta, err = cfg.metaDigest(path, fi)
+	}
 	if err != nil {
-		return nil
+		return &PathSum{Path: path, Err: err, Elap: time.Since(t0)}
 	}
 
-	results <- &PathSum{Path: path, Sum: sum}
-	return
+	return &PathSum{
+		Path:    path,
+		Sum:     sum,
+		Meta:    meta,
+		Type:    fileType(fi),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Elap:    time.Since(t0),
+	}
 }
 
 type depthWalkFunc func(path string, info os.FileInfo, depth int, err error) error
@@ -0,0 +1,111 @@
+package b3
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanFiles_UnbufferedResults(t *testing.T) {
+
+	// ScanFiles used to block until every file was hashed,
+	// so results had to be big enough to hold them all.
+	// An unbuffered results channel now must not deadlock.
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+
+	n := 50
+	files := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		path := filepath.Join(root, fmt.Sprintf("file%v", i))
+		panicOn(os.WriteFile(path, []byte(path), 0600))
+		files[path] = true
+	}
+
+	cfg := &Blake3SummerConfig{Quiet: true}
+	results := make(chan *PathSum)
+	cfg.ScanFiles(files, results)
+
+	seen := 0
+	for range results {
+		seen++
+	}
+	if seen != n {
+		t.Fatalf("want %v, got %v results", n, seen)
+	}
+}
+
+func TestScanFiles_ErrorsAreReported(t *testing.T) {
+
+	cfg := &Blake3SummerConfig{Quiet: true}
+	results := make(chan *PathSum)
+	cfg.ScanFiles(map[string]bool{"test_root_does_not_exist": true}, results)
+
+	var got []*PathSum
+	for s := range results {
+		got = append(got, s)
+	}
+	if len(got) != 1 || got[0].Err == nil || got[0].Sum != "" {
+		t.Fatalf("expected one PathSum with Err set, got %#v", got)
+	}
+}
+
+func TestWriteJSON_Summary(t *testing.T) {
+
+	cfg := &Blake3SummerConfig{}
+	ret := &DirTreeHash{
+		TopBlake3: "blake3.33B-TOP",
+		PathSums: []*PathSum{
+			{Path: "a b\n", Sum: "blake3.33B-A", Type: TypeFile, Size: 3},
+			{Path: "c", Sum: "blake3.33B-C", Type: TypeFile, Size: 4},
+		},
+		Errs: []*PathSum{{Path: "d", Err: fmt.Errorf("boom")}},
+	}
+	var buf strings.Builder
+	panicOn(cfg.WriteJSON(&buf, ret, ret.PathSums, time.Second))
+
+	var doc jsonDoc
+	panicOn(json.Unmarshal([]byte(buf.String()), &doc))
+	if len(doc.Entries) != 2 || doc.Entries[0].Path != "a b\n" {
+		t.Fatalf("entries not recovered: %v", buf.String())
+	}
+	if len(doc.Errors) != 1 || doc.Errors[0].Err != "boom" {
+		t.Fatalf("errors not recovered: %v", buf.String())
+	}
+	s := doc.Summary
+	if s.Top != ret.TopBlake3 || s.Files != 2 || s.Errors != 1 || s.Bytes != 7 {
+		t.Fatalf("bad summary: %#v", s)
+	}
+}
+
+func TestBlake3OfReader_MatchesFile(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	a := filepath.Join(root, "a")
+	data := strings.Repeat("stream me ", 100000) // > 1MB, so HashFile goes parallel.
+	panicOn(os.WriteFile(a, []byte(data), 0600))
+
+	for _, cfg := range []*Blake3SummerConfig{{}, {Hex: true, OutLen: 100, Seek: 7}} {
+		want, err := cfg.Blake3OfFile(a)
+		panicOn(err)
+		got, err := cfg.Blake3OfReader(strings.NewReader(data))
+		panicOn(err)
+		if got != want {
+			t.Fatalf("Blake3OfReader gave '%v', Blake3OfFile gave '%v'", got, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package b3
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ioprioIdle is the idle I/O scheduling class, shifted into
+// place for ioprio_set(2): the disk serves us only when no
+// one else wants it. Any user may ask for it.
+const ioprioIdle = 3 << 13
+
+const ioprioWhoProcess = 1
+
+// enterBackground puts b3 at nice 19, and in the idle I/O
+// class, for b3 -bg. On Linux both belong to each thread,
+// and new threads inherit them from the thread that makes
+// them, so we set every thread we have, until no new ones
+// turn up. The I/O class only counts with the bfq (or the
+// older cfq) I/O scheduler.
+func enterBackground() error {
+	done := make(map[int]bool)
+	for {
+		tids, err := threadIDs()
+		if err != nil {
+			return err
+		}
+		more := false
+		for _, tid := range tids {
+			if done[tid] {
+				continue
+			}
+			done[tid] = true
+			more = true
+			err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19)
+			if err == nil {
+				_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioIdle)
+				if errno != 0 {
+					err = errno
+				}
+			}
+			if err != nil && err != syscall.ESRCH { // ESRCH: the thread has exited.
+				return err
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// threadIDs lists the threads of this process.
+func threadIDs() (tids []int, err error) {
+	ents, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	for _, ent := range ents {
+		if tid, err := strconv.Atoi(ent.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package b3
+
+import (
+	"fmt"
+)
+
+func enterBackground() error {
+	return fmt.Errorf("not supported on this platform")
+}
@@ -0,0 +1,13 @@
+//go:build unix && !linux
+
+package b3
+
+import (
+	"syscall"
+)
+
+// enterBackground puts b3 at nice 19, for b3 -bg. There
+// is no portable way to lower our I/O priority as well.
+func enterBackground() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, 19)
+}
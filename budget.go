@@ -0,0 +1,59 @@
+package b3
+
+import (
+	"runtime"
+)
+
+// bytesPerThread is how much of a file each hashing thread
+// should have to itself, at least, to be worth starting.
+// blake3.HashFile2 hands out 512KB segments, and does not
+// go parallel at all for a file of one segment or less.
+const bytesPerThread = 2 << 20
+
+// cpuBudget shares a fixed number of threads (b3 -j) between
+// the files being hashed at once and the threads each of those
+// files is hashed with. Every file hashed takes at least one
+// token; a big file also takes whatever more it can use that
+// is free at the time, rather than waiting for more. So many
+// small files run one thread each on many workers, while a
+// big file found alone gets most of the CPUs, and the total
+// never goes over the budget.
+type cpuBudget struct {
+	tokens chan struct{}
+}
+
+func newCPUBudget(n int) *cpuBudget {
+	return &cpuBudget{tokens: make(chan struct{}, n)}
+}
+
+// acquire waits for a token, then takes up to as many more
+// as a file of size bytes can use, without waiting. It
+// returns how many it got; pass that to release when done.
+func (b *cpuBudget) acquire(size int64) (got int) {
+	want := int(size / bytesPerThread)
+	b.tokens <- struct{}{}
+	for got = 1; got < want; got++ {
+		select {
+		case b.tokens <- struct{}{}:
+		default:
+			return
+		}
+	}
+	return
+}
+
+func (b *cpuBudget) release(n int) {
+	for i := 0; i < n; i++ {
+		<-b.tokens
+	}
+}
+
+// jobs is how many files we hash at once, and the
+// most threads we hash with in all: b3 -j, or by
+// default, one per CPU.
+func (cfg *Blake3SummerConfig) jobs() int {
+	if cfg.Jobs > 0 {
+		return cfg.Jobs
+	}
+	return runtime.NumCPU()
+}
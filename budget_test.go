@@ -0,0 +1,29 @@
+package b3
+
+import (
+	"testing"
+)
+
+func TestCPUBudget_SharesThreads(t *testing.T) {
+
+	b := newCPUBudget(4)
+
+	// small files take one thread each.
+	if got := b.acquire(100); got != 1 {
+		t.Fatalf("small file got %v threads", got)
+	}
+	// a big file takes what is left, without waiting.
+	big := b.acquire(1 << 30)
+	if big != 3 {
+		t.Fatalf("big file should get the 3 free threads, got %v", big)
+	}
+	b.release(big)
+
+	// and no more than it can use.
+	if got := b.acquire(2 * bytesPerThread); got != 2 {
+		t.Fatalf("want 2 threads for two bytesPerThread, got %v", got)
+	}
+	if len(b.tokens) != 3 {
+		t.Fatalf("want 3 threads in use, have %v", len(b.tokens))
+	}
+}
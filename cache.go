@@ -0,0 +1,227 @@
+package b3
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// hashCacheVersion is bumped whenever the on-disk
+// layout of the cache file changes.
+const hashCacheVersion = 1
+
+// hashCache remembers the sums of files from earlier runs,
+// so that b3 -cache can skip rehashing files that have not
+// changed. A file is considered unchanged if its device,
+// inode, size, mtime and ctime all match, and it was hashed
+// with the same options (see sumParams). Since writing to a
+// file always updates its ctime, and the ctime cannot be set
+// by the user, a match means the content was not rewritten.
+//
+// The cache is a single gob-encoded file, read once at
+// startup and written atomically (temp file plus rename)
+// at the end of the run. It is keyed by absolute path.
+type hashCache struct {
+	path string
+
+	mut     sync.Mutex
+	entries map[string]*cacheEntry
+	dirty   bool
+}
+
+type cacheEntry struct {
+	Dev     uint64
+	Ino     uint64
+	Size    int64
+	MtimeNs int64
+	CtimeNs int64
+
+	// Params describes the hashing options that produced Sum.
+	Params string
+	Sum    string
+}
+
+// cacheFile is what we gob-encode to disk.
+type cacheFile struct {
+	Version int
+	Entries map[string]*cacheEntry
+}
+
+// loadHashCache reads the cache at path. A missing
+// file just gives an empty cache.
+func loadHashCache(path string) (c *hashCache, err error) {
+	c = &hashCache{
+		path:    path,
+		entries: make(map[string]*cacheEntry),
+	}
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("b3 error opening hash cache '%v': %v", path, err)
+	}
+	defer fd.Close()
+
+	var cf cacheFile
+	err = gob.NewDecoder(fd).Decode(&cf)
+	if err != nil {
+		return nil, fmt.Errorf("b3 error reading hash cache '%v': %v", path, err)
+	}
+	if cf.Version != hashCacheVersion {
+		// just start over rather than misread it.
+		return c, nil
+	}
+	if cf.Entries != nil {
+		c.entries = cf.Entries
+	}
+	return c, nil
+}
+
+// save writes the cache back to disk, if it changed.
+func (c *hashCache) save() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	err := writeFileAtomic(c.path, func(fd *os.File) error {
+		return gob.NewEncoder(fd).Encode(&cacheFile{
+			Version: hashCacheVersion,
+			Entries: c.entries,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("b3 error writing hash cache '%v': %v", c.path, err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// newCacheEntry describes fi, or returns nil if we cannot
+// identify the file well enough to trust a cached sum.
+func newCacheEntry(fi os.FileInfo, params string) *cacheEntry {
+	dev, ino, ctimeNs, ok := statIdent(fi)
+	if !ok || !fi.Mode().IsRegular() {
+		return nil
+	}
+	return &cacheEntry{
+		Dev:     dev,
+		Ino:     ino,
+		Size:    fi.Size(),
+		MtimeNs: fi.ModTime().UnixNano(),
+		CtimeNs: ctimeNs,
+		Params:  params,
+	}
+}
+
+func (e *cacheEntry) matches(o *cacheEntry) bool {
+	return e.Dev == o.Dev &&
+		e.Ino == o.Ino &&
+		e.Size == o.Size &&
+		e.MtimeNs == o.MtimeNs &&
+		e.CtimeNs == o.CtimeNs &&
+		e.Params == o.Params
+}
+
+// get returns the cached sum for path, if fi still
+// describes the same file contents.
+func (c *hashCache) get(path string, fi os.FileInfo, params string) (sum string, ok bool) {
+	want := newCacheEntry(fi, params)
+	if want == nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	e, ok := c.entries[abs]
+	if !ok || !e.matches(want) {
+		return "", false
+	}
+	return e.Sum, true
+}
+
+// put remembers sum for path. fi must be from before the
+// hashing began. Like git's index, we refuse to trust a file
+// changed within the last two seconds, since a write in the
+// same timestamp tick as our read would go unnoticed.
+func (c *hashCache) put(path string, fi os.FileInfo, params, sum string, t0 time.Time) {
+	e := newCacheEntry(fi, params)
+	if e == nil {
+		return
+	}
+	racy := t0.Add(-2 * time.Second).UnixNano()
+	if e.MtimeNs >= racy || e.CtimeNs >= racy {
+		return
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	e.Sum = sum
+
+	c.mut.Lock()
+	c.entries[abs] = e
+	c.dirty = true
+	c.mut.Unlock()
+}
+
+// prune drops the entries for paths that no longer exist.
+func (c *hashCache) prune() (dropped int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for path := range c.entries {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			delete(c.entries, path)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		c.dirty = true
+	}
+	return
+}
+
+// writeFileAtomic creates path by writing to a temporary
+// file in the same directory, then renaming it into place,
+// so readers see either the old file or the complete new one.
+func writeFileAtomic(path string, write func(fd *os.File) error) (err error) {
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	fd, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := fd.Name()
+	defer func() {
+		if err != nil {
+			fd.Close()
+			os.Remove(tmp)
+		}
+	}()
+	err = write(fd)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if err != nil {
+		return err
+	}
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,62 @@
+package b3
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCache_RoundTrip(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	path := filepath.Join(root, "a")
+	panicOn(os.WriteFile(path, []byte("a"), 0600))
+	cachePath := filepath.Join(root, "cache", "b3.cache")
+
+	c, err := loadHashCache(cachePath)
+	panicOn(err)
+
+	fi, err := os.Lstat(path)
+	panicOn(err)
+
+	// pretend we hashed it long after it was written,
+	// to get past the racy-file guard.
+	later := time.Now().Add(time.Minute)
+	c.put(path, fi, "mt=false", "blake3.33B-cached", later)
+	panicOn(c.save())
+
+	c2, err := loadHashCache(cachePath)
+	panicOn(err)
+	sum, ok := c2.get(path, fi, "mt=false")
+	if !ok || sum != "blake3.33B-cached" {
+		t.Fatalf("expected cache hit, got ok=%v sum='%v'", ok, sum)
+	}
+	if _, ok := c2.get(path, fi, "mt=true"); ok {
+		t.Fatalf("different hashing options should miss")
+	}
+
+	// rewriting the file changes the ctime (and here, size).
+	panicOn(os.WriteFile(path, []byte("changed"), 0600))
+	fi2, err := os.Lstat(path)
+	panicOn(err)
+	if _, ok := c2.get(path, fi2, "mt=false"); ok {
+		t.Fatalf("changed file should miss")
+	}
+
+	// a file written just now is not trusted.
+	c2.put(path, fi2, "mt=false", "blake3.33B-racy", time.Now())
+	if _, ok := c2.get(path, fi2, "mt=false"); ok {
+		t.Fatalf("racy file should not have been cached")
+	}
+
+	panicOn(os.Remove(path))
+	if dropped := c2.prune(); dropped != 1 {
+		t.Fatalf("want 1 pruned, got %v", dropped)
+	}
+}
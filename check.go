@@ -0,0 +1,336 @@
+package b3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ManifestEntry is one path and its expected checksum,
+// as read back from a line of previous b3 output.
+type ManifestEntry struct {
+	Path string
+	Sum  string
+
+	// Meta is the metadata digest, from b3 -meta.
+	Meta string
+
+	// Line is the 1-based line number in the manifest.
+	Line int
+}
+
+// isHexSum reports if s looks like the output of b3 -hex.
+func isHexSum(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isSum reports if s is a checksum that b3 could have printed.
+func isSum(s string) bool {
+	_, ok := parseSumFormat(s)
+	return ok || isTreeSum(s) || isDirSum(s)
+}
+
+// sumFormat is what the label of a file sum tells us
+// about how it was made; see sumLabel.
+type sumFormat struct {
+	keying string
+	n      int
+	seek   int64
+	hex    bool
+}
+
+// parseSumFormat reads the label of file sum s, like
+// "blake3.33B-" or "blake3k.8B@64.hex-", or recognizes
+// s as an unlabeled -hex sum.
+func parseSumFormat(s string) (f sumFormat, ok bool) {
+	if isHexSum(s) {
+		return sumFormat{n: 32, hex: true}, true
+	}
+	rest, ok := strings.CutPrefix(s, "blake3")
+	if !ok || rest == "" {
+		return f, false
+	}
+	if rest[0] == 'k' || rest[0] == 'd' {
+		f.keying, rest = rest[:1], rest[1:]
+	}
+	rest, ok = strings.CutPrefix(rest, ".")
+	if !ok {
+		return f, false
+	}
+	label, payload, ok := strings.Cut(rest, "-")
+	if !ok || payload == "" {
+		return f, false
+	}
+	if label == "hex" {
+		f.n, f.hex = 32, true
+		return f, true
+	}
+	label, f.hex = strings.CutSuffix(label, ".hex")
+	num, at, hasSeek := strings.Cut(label, "@")
+	num, ok = strings.CutSuffix(num, "B")
+	if !ok {
+		return f, false
+	}
+	var err error
+	f.n, err = strconv.Atoi(num)
+	if err != nil || f.n < 1 {
+		return f, false
+	}
+	if hasSeek {
+		f.seek, err = strconv.ParseInt(at, 10, 64)
+		if err != nil || f.seek < 0 {
+			return f, false
+		}
+	}
+	return f, true
+}
+
+// applySumFormat sets cfg up to make sums in format f.
+// The keying is not changed; see checkKeying.
+func (cfg *Blake3SummerConfig) applySumFormat(f sumFormat) {
+	cfg.Hex = f.hex
+	cfg.OutLen = f.n
+	cfg.Seek = f.seek
+}
+
+// isDirSum reports if s is the sum of a
+// directory entry, from b3 -dirs.
+func isDirSum(s string) bool {
+	return strings.HasPrefix(s, "b3dir")
+}
+
+// isTreeSum reports if s is a directory or hash of hashes
+// sum, from b3 -tree or -dirsums.
+func isTreeSum(s string) bool {
+	return strings.HasPrefix(s, "b3tree")
+}
+
+// ParseManifest reads the output of a previous b3 run and
+// returns just its entries; see ReadManifest.
+func ParseManifest(r io.Reader) (entries []*ManifestEntry, err error) {
+	m, err := ReadManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.Entries, nil
+}
+
+// ReadManifest reads the output of a previous b3 run: either
+// a manifest written by b3 -o, or what b3 printed. Both the
+// default "sum   path" layout and the "path   sum" layout of
+// b3 -s are understood, as are base64 and -hex sums. Directory
+// hashes from b3 -dirsums, and the rate report from b3 -f,
+// are skipped.
+func ReadManifest(r io.Reader) (m *Manifest, err error) {
+	m = &Manifest{}
+	scanner := bufio.NewScanner(r)
+	// allow very long paths
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, manifestMagic) {
+			err = parseManifestHeader(line, m)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, manifestTopTag) {
+			m.Top = strings.TrimPrefix(line, manifestTopTag)
+			continue
+		}
+		if top, ok := strings.CutSuffix(line, "   [hash of hashes; checksum of above]"); ok {
+			m.Top = top
+			continue
+		}
+		if strings.Contains(line, " MB.  elap = ") {
+			continue
+		}
+		escaped := strings.HasPrefix(line, `\`)
+		if escaped {
+			line = line[1:]
+		}
+		i := strings.Index(line, "   ")
+		if i < 0 {
+			return nil, fmt.Errorf("b3 error: manifest line %v has no sum: '%v'", lineNum, line)
+		}
+		e := &ManifestEntry{Line: lineNum}
+		if sum, meta, ok := splitSumField(line[:i]); ok {
+			e.Sum, e.Meta = sum, meta
+			e.Path = line[i+3:]
+		} else {
+			// paths first, from b3 -s. The sum has no runs of
+			// spaces in it, so the last separator is the one we want.
+			j := strings.LastIndex(line, "   ")
+			sum, meta, ok := splitSumField(line[j+3:])
+			if !ok {
+				return nil, fmt.Errorf("b3 error: manifest line %v has no sum: '%v'", lineNum, line)
+			}
+			e.Path = line[:j]
+			e.Sum, e.Meta = sum, meta
+		}
+		if isTreeSum(e.Sum) {
+			continue
+		}
+		if escaped {
+			e.Path = unescapeManifestPath(e.Path)
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("b3 error reading manifest: %v", err)
+	}
+	return
+}
+
+// CheckManifest re-hashes every file listed in the manifest at
+// manifestPath, in parallel, and prints OK, FAILED, or MISSING
+// for each path. The returned bad count is the number of
+// paths that did not verify; err is non-nil if bad > 0.
+func (cfg *Blake3SummerConfig) CheckManifest(manifestPath string) (bad int, err error) {
+
+	fd, err := os.Open(manifestPath)
+	if err != nil {
+		return 0, fmt.Errorf("b3 error opening manifest '%v': %v", manifestPath, err)
+	}
+	m, err := ReadManifest(fd)
+	fd.Close()
+	if err != nil {
+		return 0, err
+	}
+	entries := m.Entries
+	if len(entries) == 0 {
+		return 0, fmt.Errorf("b3 error: no sums found in manifest '%v'", manifestPath)
+	}
+
+	// hash with the same encoding the manifest used.
+	// Never trust the hash cache when verifying: bit rot
+	// does not change the mtime or ctime.
+	c2 := *cfg
+	c2.cache = nil
+	err = c2.applyManifestHeader(m)
+	if err != nil {
+		return 0, err
+	}
+	// directory entries, from b3 -dirs, are only checked
+	// to still be directories; their sums depend on what
+	// the walk that made them left out.
+	var firstSum string
+	for _, e := range entries {
+		if !isDirSum(e.Sum) {
+			firstSum = e.Sum
+			break
+		}
+	}
+	first, _ := parseSumFormat(firstSum)
+	c2.applySumFormat(first)
+	err = c2.checkKeying(manifestPath, entries[0].Sum)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if isDirSum(e.Sum) {
+			continue
+		}
+		if f, _ := parseSumFormat(e.Sum); f != first {
+			return 0, fmt.Errorf("b3 error: manifest '%v' mixes sum formats (hex, base64, length, or keying) at line %v", manifestPath, e.Line)
+		}
+	}
+
+	stopProgress := c2.startProgress()
+	defer stopProgress()
+
+	missing := make(map[string]bool)
+	notDir := make(map[string]bool)
+	fileMap := make(map[string]bool)
+	for _, e := range entries {
+		fi, err := os.Lstat(e.Path)
+		if err != nil {
+			missing[e.Path] = true
+			continue
+		}
+		if isDirSum(e.Sum) {
+			notDir[e.Path] = !fi.IsDir()
+			continue
+		}
+		fileMap[e.Path] = true
+		c2.progress.foundFile(fi.Size())
+	}
+	c2.progress.walkDone()
+
+	results := make(chan *PathSum, 1024)
+	c2.ScanFiles(fileMap, results)
+
+	got := make(map[string]*PathSum)
+	for s := range results {
+		if s.Err != nil {
+			// reported below as FAILED open or read
+			continue
+		}
+		got[s.Path] = s
+	}
+
+	// content and metadata mismatches are counted, and
+	// reported, separately.
+	badContent, badMeta, badOther := 0, 0, 0
+	for _, e := range entries {
+		var status string
+		s, ok := got[e.Path]
+		switch {
+		case missing[e.Path]:
+			status = "MISSING"
+			badOther++
+		case isDirSum(e.Sum):
+			status = "OK"
+			if notDir[e.Path] {
+				status = "FAILED not a directory"
+				badOther++
+			}
+		case !ok:
+			status = "FAILED open or read"
+			badOther++
+		case s.Sum != e.Sum && e.Meta != "" && s.Meta != e.Meta:
+			status = "FAILED, METADATA FAILED"
+			badContent++
+			badMeta++
+		case s.Sum != e.Sum:
+			status = "FAILED"
+			badContent++
+		case e.Meta != "" && s.Meta != e.Meta:
+			status = "METADATA FAILED"
+			badMeta++
+		default:
+			status = "OK"
+		}
+		if status != "OK" {
+			bad++
+		}
+		if status != "OK" || !cfg.Quiet {
+			fmt.Printf("%v: %v\n", e.Path, status)
+		}
+	}
+	if bad > 0 {
+		return bad, fmt.Errorf("b3 error: %v of %v files did not verify (%v content, %v metadata, %v missing or unreadable)",
+			bad, len(entries), badContent, badMeta, badOther)
+	}
+	return
+}
@@ -0,0 +1,185 @@
+package b3
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseManifest_BothLayouts(t *testing.T) {
+
+	in := `blake3.33B-gcS39-BUnxUU6crpfPQM8TOSBBjT3HG-2_YOyb1hSMvZ   a
+blake3.33B-nZAvmGTzBD3Kl-QGmO7gei_mdxWRxoftEpzej2_MSnl7   b   c
+blake3.33B-QkEI6sZWJYmrn79y2Hv1j9I4VTbbQKTkXwUigtc3sREP   [hash of hashes; checksum of above]
+b   c   9d902f9864f3043dca97e40698eee07a2fe6771591c687ed129cde8f6fcc4a79
+`
+	entries, err := ParseManifest(strings.NewReader(in))
+	panicOn(err)
+	if len(entries) != 3 {
+		t.Fatalf("want 3 entries, got %v", len(entries))
+	}
+	if entries[1].Path != "b   c" || entries[2].Path != "b   c" {
+		t.Fatalf("paths with the separator in them were not preserved: '%v', '%v'",
+			entries[1].Path, entries[2].Path)
+	}
+	if !isHexSum(entries[2].Sum) {
+		t.Fatalf("expected hex sum on the -s line, got '%v'", entries[2].Sum)
+	}
+
+	_, err = ParseManifest(strings.NewReader("no sum here\n"))
+	if err == nil {
+		t.Fatalf("expected error on a line without a sum")
+	}
+}
+
+func TestCheckManifest(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	a := filepath.Join(root, "a")
+	b := filepath.Join(root, "b")
+	panicOn(os.WriteFile(a, []byte("a"), 0600))
+	panicOn(os.WriteFile(b, []byte("b"), 0600))
+
+	cfg := &Blake3SummerConfig{Quiet: true}
+	sumA, err := cfg.Blake3OfFile(a)
+	panicOn(err)
+	sumB, err := cfg.Blake3OfFile(b)
+	panicOn(err)
+
+	manifest := filepath.Join(root, "manifest.b3")
+	panicOn(os.WriteFile(manifest, []byte(sumA+"   "+a+"\n"+sumB+"   "+b+"\n"), 0600))
+
+	bad, err := cfg.CheckManifest(manifest)
+	if err != nil || bad != 0 {
+		t.Fatalf("expected clean verify, got bad=%v err='%v'", bad, err)
+	}
+
+	panicOn(os.WriteFile(a, []byte("changed"), 0600))
+	panicOn(os.Remove(b))
+	bad, err = cfg.CheckManifest(manifest)
+	if err == nil || bad != 2 {
+		t.Fatalf("expected 2 bad, got bad=%v err='%v'", bad, err)
+	}
+}
+
+func TestManifest_RoundTrip(t *testing.T) {
+
+	cfg := &Blake3SummerConfig{ModTimeHash: true, TreeVersion: TreePaths}
+	sums := []*PathSum{
+		{Path: "plain", Sum: "blake3.33B-P"},
+		{Path: "new\nline\\slash", Sum: "blake3.33B-N"},
+	}
+	var buf strings.Builder
+	panicOn(cfg.WriteManifest(&buf, sums, "b3tree1.33B-TOP"))
+
+	m, err := ReadManifest(strings.NewReader(buf.String()))
+	panicOn(err)
+	if m.Version != ManifestVersion || m.Header["mt"] != "true" || m.Header["tree"] != "1" {
+		t.Fatalf("header not recovered: %v %#v", m.Version, m.Header)
+	}
+	if m.Top != "b3tree1.33B-TOP" {
+		t.Fatalf("top not recovered: '%v'", m.Top)
+	}
+	if len(m.Entries) != 2 || m.Entries[1].Path != sums[1].Path || m.Entries[1].Sum != sums[1].Sum {
+		t.Fatalf("escaped path not recovered: %#v", m.Entries)
+	}
+
+	c2 := &Blake3SummerConfig{}
+	panicOn(c2.applyManifestHeader(m))
+	if !c2.ModTimeHash {
+		t.Fatalf("expected -mt from the header")
+	}
+
+	_, err = ReadManifest(strings.NewReader("#b3-manifest v99\n"))
+	if err == nil {
+		t.Fatalf("expected error on a manifest from the future")
+	}
+}
+
+func TestSumLenAndSeek(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	a := filepath.Join(root, "a")
+	panicOn(os.WriteFile(a, []byte("a"), 0600))
+
+	long := &Blake3SummerConfig{Hex: true, OutLen: 3000}
+	sumLong, err := long.Blake3OfFile(a)
+	panicOn(err)
+	hexLong := strings.TrimPrefix(sumLong, "blake3.3000B.hex-")
+
+	var short *Blake3SummerConfig
+	for _, seek := range []int64{1, 64, 1024, 2050} {
+		short = &Blake3SummerConfig{Hex: true, OutLen: 4, Seek: seek}
+		sumShort, err := short.Blake3OfFile(a)
+		panicOn(err)
+		hexShort := strings.TrimPrefix(sumShort, fmt.Sprintf("blake3.4B@%v.hex-", seek))
+		if hexShort != hexLong[2*seek:2*seek+8] {
+			t.Fatalf("-seek %v -len 4 gave '%v', not the same bytes of -len 3000", seek, sumShort)
+		}
+	}
+
+	for _, c := range []*Blake3SummerConfig{long, short, {}, {Hex: true}, {OutLen: 7}} {
+		sum, err := c.Blake3OfFile(a)
+		panicOn(err)
+		f, ok := parseSumFormat(sum)
+		if !ok {
+			t.Fatalf("could not parse the label of '%v'", sum)
+		}
+		c2 := &Blake3SummerConfig{}
+		c2.applySumFormat(f)
+		sum2, err := c2.Blake3OfFile(a)
+		panicOn(err)
+		if sum2 != sum {
+			t.Fatalf("format of '%v' not recovered from its label: got '%v'", sum, sum2)
+		}
+	}
+}
+
+func TestPrintSum_ReadsBack(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+	panicOn(os.MkdirAll(root, 0700))
+
+	paths := []string{"plain", `\leading`, "new\nline"}
+	for _, pathsFirst := range []bool{false, true} {
+		out, err := os.Create(filepath.Join(root, "out"))
+		panicOn(err)
+		stdout := os.Stdout
+		os.Stdout = out
+		cfg := &Blake3SummerConfig{PathsFirst: pathsFirst}
+		for _, path := range paths {
+			cfg.printSum(&PathSum{Path: path, Sum: "blake3.33B-S"})
+		}
+		os.Stdout = stdout
+		panicOn(out.Close())
+
+		fd, err := os.Open(filepath.Join(root, "out"))
+		panicOn(err)
+		entries, err := ParseManifest(fd)
+		fd.Close()
+		panicOn(err)
+		if len(entries) != len(paths) {
+			t.Fatalf("-s=%v: want %v entries, got %v", pathsFirst, len(paths), len(entries))
+		}
+		for i, e := range entries {
+			if e.Path != paths[i] || e.Sum != "blake3.33B-S" {
+				t.Fatalf("-s=%v: want '%v', got '%v' (%v)", pathsFirst, paths[i], e.Path, e.Sum)
+			}
+		}
+	}
+}
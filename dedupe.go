@@ -0,0 +1,428 @@
+package b3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The ways b3 dupes -link can replace a duplicate.
+const (
+	// LinkHard makes the duplicate a hard link to the
+	// file kept. The two names then share one inode, so
+	// they share permissions, owner and mtime as well.
+	LinkHard = "hard"
+
+	// LinkReflink makes the duplicate share the kept
+	// file's data blocks, copy-on-write (Linux, on btrfs
+	// or XFS). The duplicate stays a file of its own.
+	LinkReflink = "reflink"
+)
+
+// dedupeRecord is one line of the b3 dupes -log file:
+// enough to turn the linked duplicate at Path back
+// into a file of its own.
+type dedupeRecord struct {
+	Action string `json:"action"`
+
+	// Path and Kept are absolute.
+	Path string `json:"path"`
+	Kept string `json:"kept"`
+
+	Sum  string `json:"sum"`
+	Size int64  `json:"size"`
+
+	// Mode is the permission bits, with setuid,
+	// setgid and sticky.
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+
+	// UID and GID are -1 if unknown.
+	UID int64 `json:"uid"`
+	GID int64 `json:"gid"`
+}
+
+const permBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Dedupe replaces the duplicates in each group with links
+// to the group's first path, using cfg.DupeLink (LinkHard
+// or LinkReflink). Before each link the duplicate is compared
+// byte for byte with the kept file, since either may have
+// changed since it was hashed. Hard links are only made
+// between files with the same permissions, owner and mtime,
+// as linking would change them; a reflinked duplicate keeps its
+// own, and its mtime is put back afterwards.
+//
+// Each action is recorded in the cfg.DupeLog file, if any,
+// before it is taken, so UndoDedupe can reverse it. With
+// cfg.DryRun, nothing is changed or logged. What is done (or
+// would be) is reported on out. linked and saved count the
+// duplicates linked and the bytes that freed.
+func (cfg *Blake3SummerConfig) Dedupe(groups []*DupeGroup, out io.Writer) (linked int, saved int64, err error) {
+
+	var log *os.File
+	if cfg.DupeLog != "" && !cfg.DryRun {
+		log, err = os.OpenFile(cfg.DupeLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, 0, fmt.Errorf("b3 error: could not open -log file: %v", err)
+		}
+		defer func() {
+			err2 := log.Close()
+			if err == nil {
+				err = err2
+			}
+		}()
+	}
+
+	verb := "hardlinked"
+	if cfg.DupeLink == LinkReflink {
+		verb = "reflinked"
+	}
+	if cfg.DryRun {
+		verb = "would have " + verb
+	}
+
+	failed := 0
+	for _, g := range groups {
+		kept := g.Paths[0]
+		for _, path := range g.Paths[1:] {
+			rec, skip, err := cfg.checkDupe(g, kept, path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "b3 error on path '%v': %v\n", path, err)
+				failed++
+				continue
+			}
+			if skip != "" {
+				fmt.Fprintf(os.Stderr, "b3 dupes: skipping '%v': %v\n", path, skip)
+				continue
+			}
+			if !cfg.DryRun {
+				if log != nil {
+					err = writeDedupeRecord(log, rec)
+					if err != nil {
+						return linked, saved, fmt.Errorf("b3 error: could not write -log file: %v", err)
+					}
+				}
+				if cfg.DupeLink == LinkReflink {
+					err = reflinkDupe(rec)
+				} else {
+					err = hardlinkDupe(kept, path)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "b3 error on path '%v': %v\n", path, err)
+					failed++
+					continue
+				}
+			}
+			fmt.Fprintf(out, "%v: %v -> %v\n", verb, path, kept)
+			linked++
+			saved += g.Size
+		}
+	}
+	if failed > 0 {
+		return linked, saved, fmt.Errorf("b3 error: %v duplicate(s) could not be linked", failed)
+	}
+	return linked, saved, nil
+}
+
+// checkDupe makes sure path is still a duplicate of kept
+// that we can link, returning the record for the -log file.
+// A non-empty skip says why we should leave path alone.
+func (cfg *Blake3SummerConfig) checkDupe(g *DupeGroup, kept, path string) (rec *dedupeRecord, skip string, err error) {
+
+	kfi, err := os.Lstat(kept)
+	if err != nil {
+		return nil, "", err
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if !kfi.Mode().IsRegular() || !fi.Mode().IsRegular() ||
+		kfi.Size() != g.Size || fi.Size() != g.Size {
+		return nil, "it or '" + kept + "' changed since it was hashed", nil
+	}
+
+	rec = &dedupeRecord{
+		Action:  cfg.DupeLink,
+		Path:    path,
+		Kept:    kept,
+		Sum:     g.Sum,
+		Size:    g.Size,
+		Mode:    fi.Mode() & permBits,
+		ModTime: fi.ModTime(),
+		UID:     -1,
+		GID:     -1,
+	}
+	if uid, gid, ok := statOwner(fi); ok {
+		rec.UID, rec.GID = int64(uid), int64(gid)
+	}
+	// so that -undo works from any directory.
+	rec.Path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	rec.Kept, err = filepath.Abs(kept)
+	if err != nil {
+		return nil, "", err
+	}
+
+	kdev, kino, _, kok := statIdent(kfi)
+	dev, ino, _, ok := statIdent(fi)
+	if kok && ok {
+		if kdev == dev && kino == ino {
+			return nil, "already a hard link to '" + kept + "'", nil
+		}
+		if kdev != dev {
+			return nil, "not on the same filesystem as '" + kept + "'", nil
+		}
+	}
+	if cfg.DupeLink == LinkHard {
+		kuid, kgid, _ := statOwner(kfi)
+		if kfi.Mode()&permBits != rec.Mode || int64(kuid) != rec.UID || int64(kgid) != rec.GID ||
+			!kfi.ModTime().Equal(rec.ModTime) {
+			return nil, "its permissions, owner or mtime differ from '" + kept + "'", nil
+		}
+	}
+
+	same, err := sameContents(kept, path)
+	if err != nil {
+		return nil, "", err
+	}
+	if !same {
+		return nil, "its contents no longer match '" + kept + "'", nil
+	}
+	// and nobody wrote to it while we compared.
+	fi2, err := os.Lstat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if fi2.Size() != fi.Size() || !fi2.ModTime().Equal(fi.ModTime()) {
+		return nil, "it changed while we compared it", nil
+	}
+	return rec, "", nil
+}
+
+// sameContents compares two files byte for byte.
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufa := make([]byte, 1<<16)
+	bufb := make([]byte, 1<<16)
+	for {
+		na, erra := io.ReadFull(fa, bufa)
+		nb, errb := io.ReadFull(fb, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		aDone := erra == io.EOF || erra == io.ErrUnexpectedEOF
+		bDone := errb == io.EOF || errb == io.ErrUnexpectedEOF
+		switch {
+		case erra != nil && !aDone:
+			return false, erra
+		case errb != nil && !bDone:
+			return false, errb
+		case aDone || bDone:
+			return aDone == bDone, nil
+		}
+	}
+}
+
+// hardlinkDupe replaces path with a hard link to kept,
+// atomically, by linking under a temporary name in path's
+// directory and renaming that over path.
+func hardlinkDupe(kept, path string) error {
+	dir, base := filepath.Split(path)
+	for i := 0; ; i++ {
+		tmp := filepath.Join(dir, fmt.Sprintf(".%v.b3link%v", base, rand.Int63()))
+		err := os.Link(kept, tmp)
+		if os.IsExist(err) && i < 10 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, path)
+		if err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	}
+}
+
+// reflinkDupe replaces the contents of rec.Path, in place,
+// with a reflink to rec.Kept, then puts its mtime back.
+// Its inode, and so its permissions, owner and xattrs,
+// are unchanged.
+func reflinkDupe(rec *dedupeRecord) error {
+	src, err := os.Open(rec.Kept)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(rec.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = reflink(dst, src)
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(rec.Path, time.Time{}, rec.ModTime)
+}
+
+func writeDedupeRecord(log *os.File, rec *dedupeRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = log.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return log.Sync()
+}
+
+// UndoDedupe reverses the links recorded in the b3 dupes
+// -log file at logPath, newest first, giving each linked
+// duplicate its own copy of the data again, with its
+// recorded permissions, owner (if we may) and mtime. A
+// duplicate that is no longer linked to the file kept, or
+// was never linked, is left alone. With cfg.DryRun, nothing
+// is changed. What is done (or would be) is reported on out.
+func (cfg *Blake3SummerConfig) UndoDedupe(logPath string, out io.Writer) (restored int, err error) {
+
+	fd, err := os.Open(logPath)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	var recs []*dedupeRecord
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		rec := &dedupeRecord{}
+		err = json.Unmarshal(scanner.Bytes(), rec)
+		if err != nil {
+			return 0, fmt.Errorf("b3 error: '%v' line %v is not a b3 dupes -log record: %v", logPath, n, err)
+		}
+		recs = append(recs, rec)
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	verb := "restored"
+	if cfg.DryRun {
+		verb = "would have restored"
+	}
+	failed := 0
+	for i := len(recs) - 1; i >= 0; i-- {
+		rec := recs[i]
+		skip, err := checkUndo(rec)
+		if err == nil && skip == "" && !cfg.DryRun {
+			err = undoDupe(rec)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "b3 error on path '%v': %v\n", rec.Path, err)
+			failed++
+			continue
+		}
+		if skip != "" {
+			fmt.Fprintf(os.Stderr, "b3 dupes: skipping '%v': %v\n", rec.Path, skip)
+			continue
+		}
+		fmt.Fprintf(out, "%v: %v\n", verb, rec.Path)
+		restored++
+	}
+	if failed > 0 {
+		return restored, fmt.Errorf("b3 error: %v duplicate(s) could not be restored", failed)
+	}
+	return restored, nil
+}
+
+// checkUndo says why rec should not be undone, if it should not.
+func checkUndo(rec *dedupeRecord) (skip string, err error) {
+	fi, err := os.Lstat(rec.Path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() != rec.Size {
+		return "it changed since it was linked", nil
+	}
+	if rec.Action != LinkHard {
+		return "", nil
+	}
+	kfi, err := os.Lstat(rec.Kept)
+	if err != nil {
+		return "", err
+	}
+	if !os.SameFile(fi, kfi) {
+		return "it is not a hard link to '" + rec.Kept + "'", nil
+	}
+	return "", nil
+}
+
+// undoDupe gives rec.Path its own copy of the data. A hard
+// link is replaced, atomically, with a new file; a reflinked
+// file is rewritten in place, which unshares its blocks.
+func undoDupe(rec *dedupeRecord) error {
+	src, err := os.Open(rec.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	switch rec.Action {
+	case LinkHard:
+		err = writeFileAtomic(rec.Path, func(fd *os.File) error {
+			_, err := io.Copy(fd, src)
+			if err != nil {
+				return err
+			}
+			if rec.UID >= 0 && rec.GID >= 0 {
+				// only root can give files away; otherwise
+				// the copy belongs to whoever runs the undo.
+				fd.Chown(int(rec.UID), int(rec.GID))
+			}
+			return fd.Chmod(rec.Mode)
+		})
+	case LinkReflink:
+		var dst *os.File
+		dst, err = os.OpenFile(rec.Path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		if err == nil {
+			err = dst.Sync()
+		}
+		if err2 := dst.Close(); err == nil {
+			err = err2
+		}
+	default:
+		return fmt.Errorf("b3 error: unknown -log action '%v'", rec.Action)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(rec.Path, time.Time{}, rec.ModTime)
+}
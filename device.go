@@ -0,0 +1,250 @@
+package b3
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hddBatch is how many paths on a spinning disk we take,
+// at most, from those queued while the last batch was read,
+// to sort into the order they lie on the disk and read.
+// Bigger batches seek less, but hold more paths in memory.
+const hddBatch = 1 << 14
+
+// maxQueued is how many paths may wait, at most, in all
+// the devices' queues together, before adding another waits
+// for one to be taken. It keeps the walk from running
+// arbitrarily far ahead of the hashing, while leaving room
+// for a fast disk's paths behind a slow disk's.
+const maxQueued = 1 << 18
+
+// deviceScheduler routes the paths to be hashed to a worker
+// pool per device (st_dev), so that a slow disk does not hold
+// up a fast one, and each can be read the way that suits it.
+// Each pool has a diskQueue of its own, so adding a path only
+// waits when maxQueued paths are queued in all of them.
+type deviceScheduler struct {
+	cfg     *Blake3SummerConfig
+	results chan<- *PathSum
+
+	wg     sync.WaitGroup
+	queues map[uint64]*diskQueue
+
+	// a token for each path queued, shared by the queues.
+	slots chan struct{}
+
+	// the device of the directory we saw last. Walks
+	// go a directory at a time, so one Stat of each
+	// mostly does; its files are on the same device.
+	lastDir string
+	lastDev uint64
+}
+
+func (cfg *Blake3SummerConfig) newDeviceScheduler(results chan<- *PathSum) *deviceScheduler {
+	return &deviceScheduler{
+		cfg:     cfg,
+		results: results,
+		queues:  make(map[uint64]*diskQueue),
+		slots:   make(chan struct{}, maxQueued),
+	}
+}
+
+// add queues path on its device, starting a pool for the
+// device the first time we see it. Paths whose directory
+// we cannot Stat go to device 0, to have their error reported.
+func (d *deviceScheduler) add(path string) {
+	dev := d.deviceOf(path)
+	q, ok := d.queues[dev]
+	if !ok {
+		q = newDiskQueue(d.slots)
+		d.queues[dev] = q
+		rot := dev != 0 && deviceRotational(dev)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if rot {
+				d.cfg.scanSpinning(q, d.results)
+			} else {
+				d.cfg.scanPool(q.next, d.cfg.jobs(), d.results)
+			}
+		}()
+	}
+	q.push(path)
+}
+
+// deviceOf is the device holding the directory path is in.
+func (d *deviceScheduler) deviceOf(path string) uint64 {
+	dir := filepath.Dir(strings.TrimSuffix(path, "/"))
+	if dir == d.lastDir {
+		return d.lastDev
+	}
+	var dev uint64
+	if fi, err := os.Stat(dir); err == nil {
+		dev, _, _, _ = statIdent(fi)
+	}
+	d.lastDir, d.lastDev = dir, dev
+	return dev
+}
+
+// wait closes the queues, then waits for every pool to finish.
+func (d *deviceScheduler) wait() {
+	for _, q := range d.queues {
+		q.close()
+	}
+	d.wg.Wait()
+}
+
+// diskQueue is a queue of the paths for one device's pool.
+// Its length is bounded only by slots, which the queues of
+// other devices share: push takes a token from slots, and
+// take gives them back.
+type diskQueue struct {
+	slots chan struct{}
+
+	mut    sync.Mutex
+	ready  *sync.Cond
+	paths  []string
+	closed bool
+}
+
+func newDiskQueue(slots chan struct{}) *diskQueue {
+	q := &diskQueue{slots: slots}
+	q.ready = sync.NewCond(&q.mut)
+	return q
+}
+
+// push queues path, first waiting for a token from slots.
+func (q *diskQueue) push(path string) {
+	q.slots <- struct{}{}
+	q.mut.Lock()
+	q.paths = append(q.paths, path)
+	q.mut.Unlock()
+	q.ready.Signal()
+}
+
+func (q *diskQueue) close() {
+	q.mut.Lock()
+	q.closed = true
+	q.mut.Unlock()
+	q.ready.Broadcast()
+}
+
+// take waits for paths to be queued, then takes the first
+// of them, up to max. It returns none once q is closed and
+// empty.
+func (q *diskQueue) take(max int) (paths []string) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	for len(q.paths) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	n := min(max, len(q.paths))
+	paths = append(paths, q.paths[:n]...)
+	clear(q.paths[:n])
+	q.paths = q.paths[n:]
+	for range paths {
+		<-q.slots
+	}
+	return
+}
+
+// scanPool hashes the paths from next with n workers,
+// until next has no more.
+func (cfg *Blake3SummerConfig) scanPool(next func() (string, bool), n int, results chan<- *PathSum) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				path, ok := next()
+				if !ok {
+					return
+				}
+				// any error is reported on the PathSum
+				cfg.ScanOneFile(path, results)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// next takes the next path from q, for scanPool.
+func (q *diskQueue) next() (string, bool) {
+	paths := q.take(1)
+	if len(paths) == 0 {
+		return "", false
+	}
+	return paths[0], true
+}
+
+// scanSpinning hashes the paths from q, on a spinning disk,
+// with only cfg.hddJobs() workers, in batches sorted by where
+// the files lie on the disk, to keep the heads from thrashing.
+// A batch is whatever has queued up, up to hddBatch paths, by
+// the time the last one is all handed out. We never wait for
+// more, since the walk may be waiting on us (see reorderBuffer).
+func (cfg *Blake3SummerConfig) scanSpinning(q *diskQueue, results chan<- *PathSum) {
+	work := make(chan string)
+	go func() {
+		defer close(work)
+		for {
+			batch := q.take(hddBatch)
+			if len(batch) == 0 {
+				return
+			}
+			for _, path := range sortByDisk(batch) {
+				work <- path
+			}
+		}
+	}()
+	cfg.scanPool(func() (string, bool) {
+		path, ok := <-work
+		return path, ok
+	}, cfg.hddJobs(), results)
+}
+
+// sortByDisk puts paths in the order their data lies on the
+// disk: by the physical offset of their first extent, where
+// the filesystem will tell us (FIEMAP), and otherwise by
+// inode number. We look up the extents in inode order, since
+// that is roughly the order of the inode table on disk too.
+// Files without extents (empty, inline, symlinks) go first.
+func sortByDisk(paths []string) []string {
+	ino := make(map[string]uint64)
+	for _, path := range paths {
+		if fi, err := os.Lstat(path); err == nil {
+			_, ino[path], _, _ = statIdent(fi)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return ino[paths[i]] < ino[paths[j]]
+	})
+	phys := make(map[string]uint64)
+	for _, path := range paths {
+		if off, ok := physicalOffset(path); ok {
+			phys[path] = off
+		}
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		pi, iok := phys[paths[i]]
+		pj, jok := phys[paths[j]]
+		if iok != jok {
+			return !iok
+		}
+		return pi < pj
+	})
+	return paths
+}
+
+// hddJobs is how many files we read at once from
+// each spinning disk: b3 -hddjobs, or by default, 1.
+func (cfg *Blake3SummerConfig) hddJobs() int {
+	if cfg.HDDJobs > 0 {
+		return cfg.HDDJobs
+	}
+	return 1
+}
@@ -0,0 +1,63 @@
+package b3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// deviceRotational reports if the block device dev (an
+// st_dev) is a spinning disk, according to sysfs. A partition
+// takes after its disk. Devices without a block device of
+// their own (tmpfs, NFS, btrfs subvolumes) count as not.
+func deviceRotational(dev uint64) bool {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	sys, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%v:%v", major, minor))
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		sys = filepath.Dir(sys)
+	}
+	data, err := os.ReadFile(filepath.Join(sys, "queue", "rotational"))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == "1"
+}
+
+// FS_IOC_FIEMAP from linux/fs.h, and the sizes of struct
+// fiemap and struct fiemap_extent from linux/fiemap.h.
+const (
+	fsIocFiemap      = 0xc020660b
+	fiemapHeaderSize = 32
+	fiemapExtentSize = 56
+)
+
+// physicalOffset returns where on the disk the data of the
+// regular file at path starts, if the filesystem tells us.
+func physicalOffset(path string) (uint64, bool) {
+	fd, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, false
+	}
+	defer fd.Close()
+
+	// one extent is all we want. Use uint64s, for alignment.
+	var buf [(fiemapHeaderSize + fiemapExtentSize) / 8]uint64
+	b := unsafe.Slice((*byte)(unsafe.Pointer(&buf[0])), len(buf)*8)
+	binary.NativeEndian.PutUint64(b[0:], 0)          // fm_start
+	binary.NativeEndian.PutUint64(b[8:], ^uint64(0)) // fm_length
+	binary.NativeEndian.PutUint32(b[24:], 1)         // fm_extent_count
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 || binary.NativeEndian.Uint32(b[20:]) == 0 { // fm_mapped_extents
+		return 0, false
+	}
+	return binary.NativeEndian.Uint64(b[fiemapHeaderSize+8:]), true // fe_physical
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package b3
+
+// deviceRotational is only implemented for Linux so far;
+// elsewhere, every device is read as if it were an SSD.
+func deviceRotational(dev uint64) bool {
+	return false
+}
+
+// physicalOffset is only implemented for Linux so far;
+// elsewhere, spinning disks are read in inode order.
+func physicalOffset(path string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,122 @@
+package b3
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSortByDisk_KeepsEveryPath(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	var paths []string
+	for _, name := range []string{"c", "a", "b", "empty"} {
+		path := filepath.Join(root, name)
+		data := []byte(name)
+		if name == "empty" {
+			data = nil
+		}
+		panicOn(os.WriteFile(path, data, 0600))
+		paths = append(paths, path)
+	}
+	paths = append(paths, filepath.Join(root, "gone"))
+
+	sorted := sortByDisk(append([]string{}, paths...))
+	if len(sorted) != len(paths) {
+		t.Fatalf("want %v paths, got %v", len(paths), len(sorted))
+	}
+	seen := make(map[string]bool)
+	var last uint64
+	for i, p := range sorted {
+		seen[p] = true
+		off, ok := physicalOffset(p)
+		if !ok {
+			if i > 0 {
+				if _, prevOK := physicalOffset(sorted[i-1]); prevOK {
+					t.Fatalf("'%v' has no extent, so should come before those that do", p)
+				}
+			}
+			continue
+		}
+		if off < last {
+			t.Fatalf("'%v' is out of disk order", p)
+		}
+		last = off
+	}
+	if len(seen) != len(paths) {
+		t.Fatalf("lost paths: %v", sorted)
+	}
+
+	// and hashing through a pool per device gets them all.
+	cfg := &Blake3SummerConfig{HDDJobs: 1}
+	results := make(chan *PathSum, 10)
+	files := make(map[string]bool)
+	for _, p := range paths {
+		files[p] = true
+	}
+	cfg.ScanFiles(files, results)
+	n := 0
+	for range results {
+		n++
+	}
+	if n != len(paths) {
+		t.Fatalf("want %v results, got %v", len(paths), n)
+	}
+}
+
+func TestDiskQueue_SharedLimit(t *testing.T) {
+
+	// more than any pool takes at once, with no one taking:
+	// push waits only when the shared slots are used up.
+	n := 3 * hddBatch
+	slots := make(chan struct{}, n+1)
+	q := newDiskQueue(slots)
+	for i := 0; i < n; i++ {
+		q.push(strconv.Itoa(i))
+	}
+	q.close()
+
+	other := newDiskQueue(slots)
+	other.push("last slot")
+	pushed := make(chan bool)
+	go func() {
+		other.push("waits")
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatalf("push did not wait with every slot taken")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	batch := q.take(hddBatch)
+	if len(batch) != hddBatch || batch[0] != "0" {
+		t.Fatalf("want the first %v paths, got %v of them", hddBatch, len(batch))
+	}
+	<-pushed // taking from q made room in other.
+
+	got := len(batch)
+	for {
+		path, ok := q.next()
+		if !ok {
+			break
+		}
+		if path != strconv.Itoa(got) {
+			t.Fatalf("want path %v next, got '%v'", got, path)
+		}
+		got++
+	}
+	if got != n {
+		t.Fatalf("want %v paths, got %v", n, got)
+	}
+	if len(slots) != 2 {
+		t.Fatalf("want 2 slots still held, by other, got %v", len(slots))
+	}
+}
@@ -0,0 +1,290 @@
+package b3
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Exit codes from b3 diff, like diff(1).
+const (
+	DiffIdentical = 0
+	DiffDifferent = 1
+	DiffTrouble   = 2
+)
+
+// Move is a file found under a new path with unchanged contents.
+type Move struct {
+	From string
+	To   string
+}
+
+// TreeDiff describes how the second of two trees
+// differs from the first. Paths are relative to
+// each tree's root, and sorted.
+type TreeDiff struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+	Moved    []Move
+}
+
+// Identical reports if nothing differs.
+func (d *TreeDiff) Identical() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 &&
+		len(d.Modified) == 0 && len(d.Moved) == 0
+}
+
+// DiffSums compares two trees, given as maps from relative path
+// to sum. A path only in b whose sum matches a path only in a
+// is reported as a move rather than as an add and a remove.
+func DiffSums(a, b map[string]string) (d *TreeDiff) {
+	d = &TreeDiff{}
+
+	// sum -> paths that went away with that content
+	gone := make(map[string][]string)
+	for path, sum := range a {
+		bsum, ok := b[path]
+		if !ok {
+			gone[sum] = append(gone[sum], path)
+			continue
+		}
+		if bsum != sum {
+			d.Modified = append(d.Modified, path)
+		}
+	}
+	for _, paths := range gone {
+		sort.Strings(paths)
+	}
+
+	var added []string
+	for path := range b {
+		if _, ok := a[path]; !ok {
+			added = append(added, path)
+		}
+	}
+	sort.Strings(added)
+
+	for _, path := range added {
+		sum := b[path]
+		if from := gone[sum]; len(from) > 0 {
+			d.Moved = append(d.Moved, Move{From: from[0], To: path})
+			gone[sum] = from[1:]
+			continue
+		}
+		d.Added = append(d.Added, path)
+	}
+	for _, paths := range gone {
+		d.Removed = append(d.Removed, paths...)
+	}
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+	return
+}
+
+// diffSide loads one side of a b3 diff: either a directory,
+// which is walked and hashed, or a manifest saved from a
+// previous b3 run. The result maps paths relative to the
+// directory (or to the root recorded in the manifest header,
+// if any) to their sums.
+// Loading a manifest sets the options it was made with on
+// cfg (see applyManifestHeader), for the directory side.
+func (cfg *Blake3SummerConfig) diffSide(target string) (sums map[string]string, errs []*PathSum, err error) {
+
+	sums = make(map[string]string)
+
+	if dirExists(target) {
+		root := filepath.Clean(target)
+		prefix := root + "/"
+		switch root {
+		case ".":
+			prefix = ""
+		case "/":
+			prefix = "/"
+		}
+		found, errs, err := cfg.hashWalk(func(add func(path string)) error {
+			cfg.scanOneDir(root, add)
+			return nil
+		}, nil, nil)
+		if err != nil {
+			return nil, errs, err
+		}
+		if cfg.Dirs {
+			cfg.sumDirEntries(found)
+		}
+		for _, s := range found {
+			sums[diffPath(s.Path, prefix)] = s.Sum
+		}
+		return sums, errs, nil
+	}
+
+	fd, err := os.Open(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("b3 diff error: '%v' is not a directory or a manifest: %v", target, err)
+	}
+	defer fd.Close()
+	m, err := ReadManifest(fd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("b3 diff error: '%v' is not a directory or a manifest: %v", target, err)
+	}
+	// and hash any directory side with the options, and
+	// list it by the rules, the manifest was made with.
+	err = cfg.applyManifestHeader(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	// manifests from b3 -o record the root their paths are under.
+	root := m.Header["root"]
+	for _, e := range m.Entries {
+		sums[diffPath(e.Path, root)] = e.Sum
+	}
+	return sums, nil, nil
+}
+
+// diffPath is path relative to the root it is under, for
+// b3 diff. With -dirs, the root's own entry becomes "./",
+// rather than an empty path.
+func diffPath(path, root string) string {
+	path = strings.TrimPrefix(path, root)
+	if path == "" {
+		return "./"
+	}
+	return path
+}
+
+// DiffTrees compares two targets, each a directory or a saved
+// manifest. Directories are hashed concurrently, with the same
+// options and sum encoding on both sides.
+func (cfg *Blake3SummerConfig) DiffTrees(a, b string) (d *TreeDiff, err error) {
+
+	finishCache, err := cfg.useCache()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err2 := finishCache()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	// The directory sides must hash in the same format,
+	// and list paths by the same rules, as any manifest
+	// side, so look at manifests first.
+	c2 := *cfg
+	c2.Globs = []string{"*"}
+	var formats []sumFormat
+	var sides [2]map[string]string
+	for i, target := range []string{a, b} {
+		if dirExists(target) {
+			continue
+		}
+		sides[i], _, err = c2.diffSide(target)
+		if err != nil {
+			return nil, err
+		}
+		for _, sum := range sides[i] {
+			if isDirSum(sum) {
+				continue
+			}
+			f, _ := parseSumFormat(sum)
+			formats = append(formats, f)
+			c2.applySumFormat(f)
+			err = c2.checkKeying(target, sum)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if len(formats) == 2 && formats[0] != formats[1] {
+		return nil, fmt.Errorf("b3 diff error: the manifests have different sum formats (hex, base64, length, or keying)")
+	}
+
+	stopProgress := c2.startProgress()
+	defer stopProgress()
+
+	var errs [2][]*PathSum
+	var errSide [2]error
+	done := make(chan bool)
+	running := 0
+	for i, target := range []string{a, b} {
+		if sides[i] != nil {
+			continue
+		}
+		running++
+		go func(i int, target string) {
+			sides[i], errs[i], errSide[i] = c2.diffSide(target)
+			done <- true
+		}(i, target)
+	}
+	for ; running > 0; running-- {
+		<-done
+	}
+	for i := range sides {
+		if errSide[i] != nil {
+			return nil, errSide[i]
+		}
+	}
+	if n := len(errs[0]) + len(errs[1]); n > 0 {
+		return nil, fmt.Errorf("b3 diff error: %v file(s) could not be checksummed", n)
+	}
+	return DiffSums(sides[0], sides[1]), nil
+}
+
+// DiffMain implements "b3 diff a b"; it exits
+// with DiffIdentical, DiffDifferent, or DiffTrouble.
+func DiffMain(args []string) {
+
+	cfg := &Blake3SummerConfig{}
+	fs := flag.NewFlagSet("b3 diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+b3 diff compares two directory trees, or saved b3 manifests,
+and reports files that were added, removed, modified, or moved.
+Exits 0 if identical, 1 if different, 2 on trouble.
+
+usage: b3 diff [flags] {dir|manifest} {dir|manifest}
+
+Flags:
+`)
+		fs.PrintDefaults()
+		os.Exit(DiffTrouble)
+	}
+	cfg.SetFlags(fs)
+	fs.Parse(args)
+	err := cfg.FinishConfig(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "b3 error: command line problem: '%s'\n", err)
+		os.Exit(DiffTrouble)
+	}
+	if cfg.Help || fs.NArg() != 2 {
+		fs.Usage()
+	}
+	cfg.exitUnlessBackground(DiffTrouble)
+
+	d, err := cfg.DiffTrees(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(DiffTrouble)
+	}
+	if d.Identical() {
+		os.Exit(DiffIdentical)
+	}
+	for _, path := range d.Modified {
+		fmt.Printf("modified:  %v\n", path)
+	}
+	for _, m := range d.Moved {
+		fmt.Printf("moved:     %v -> %v\n", m.From, m.To)
+	}
+	for _, path := range d.Removed {
+		fmt.Printf("removed:   %v\n", path)
+	}
+	for _, path := range d.Added {
+		fmt.Printf("added:     %v\n", path)
+	}
+	os.Exit(DiffDifferent)
+}
@@ -0,0 +1,163 @@
+package b3
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffSums_Moves(t *testing.T) {
+
+	a := map[string]string{
+		"same":     "S",
+		"changed":  "C1",
+		"gone":     "G",
+		"old/name": "M",
+		"dup1":     "D",
+		"dup2":     "D",
+	}
+	b := map[string]string{
+		"same":     "S",
+		"changed":  "C2",
+		"new/name": "M",
+		"dup3":     "D",
+		"fresh":    "F",
+	}
+	d := DiffSums(a, b)
+
+	want := &TreeDiff{
+		Added:    []string{"fresh"},
+		Removed:  []string{"dup2", "gone"},
+		Modified: []string{"changed"},
+		Moved: []Move{
+			{From: "dup1", To: "dup3"},
+			{From: "old/name", To: "new/name"},
+		},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("want %#v\n got %#v", want, d)
+	}
+	if d.Identical() || !DiffSums(a, a).Identical() {
+		t.Fatalf("Identical is wrong")
+	}
+}
+
+func TestDiffTrees_DirAgainstDir(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	for _, side := range []string{"a", "b"} {
+		panicOn(os.MkdirAll(filepath.Join(root, side, "sub"), 0700))
+		panicOn(os.WriteFile(filepath.Join(root, side, "sub", "f"), []byte("f"), 0600))
+	}
+	panicOn(os.WriteFile(filepath.Join(root, "b", "extra"), []byte("e"), 0600))
+
+	cfg := &Blake3SummerConfig{Quiet: true}
+	d, err := cfg.DiffTrees(filepath.Join(root, "a"), filepath.Join(root, "b"))
+	panicOn(err)
+	if !reflect.DeepEqual(d.Added, []string{"extra"}) || len(d.Removed)+len(d.Modified)+len(d.Moved) != 0 {
+		t.Fatalf("unexpected diff %#v", d)
+	}
+}
+
+func TestDiffTrees_DirAgainstOwnManifest(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	data := filepath.Join(root, "data")
+	panicOn(os.MkdirAll(filepath.Join(data, "sub"), 0700))
+	panicOn(os.WriteFile(filepath.Join(data, "a"), []byte("a"), 0600))
+	panicOn(os.WriteFile(filepath.Join(data, "sub", "f"), []byte("f"), 0600))
+	manifest := filepath.Join(root, "m.b3")
+
+	// b3 -r -o m.b3 data, then b3 diff data m.b3; and
+	// with -mt or -dirs, which b3 diff must take from the
+	// header.
+	for _, opt := range []string{"", "-mt", "-dirs"} {
+		args := []string{"-r", "-o", manifest, data}
+		if opt != "" {
+			args = append([]string{opt}, args...)
+		}
+		cfg := &Blake3SummerConfig{}
+		fs := flag.NewFlagSet("b3", flag.ContinueOnError)
+		cfg.SetFlags(fs)
+		panicOn(fs.Parse(args))
+		panicOn(cfg.FinishConfig(fs))
+		_, err := DirTreeBlake3Hash(cfg)
+		panicOn(err)
+
+		for _, sides := range [][2]string{{data, manifest}, {manifest, data}} {
+			d, err := (&Blake3SummerConfig{Quiet: true}).DiffTrees(sides[0], sides[1])
+			panicOn(err)
+			if !d.Identical() {
+				t.Fatalf("%v: a directory should not differ from its own manifest: %#v", opt, d)
+			}
+		}
+		if opt == "-dirs" {
+			sums, _, err := (&Blake3SummerConfig{}).diffSide(manifest)
+			panicOn(err)
+			if _, ok := sums["./"]; !ok || len(sums) != 4 {
+				t.Fatalf("want the root as ./, among 4 paths: %v", sums)
+			}
+		}
+	}
+}
+
+func TestDiffTrees_ManifestListingRules(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	data := filepath.Join(root, "data")
+	panicOn(os.MkdirAll(data, 0700))
+	for _, name := range []string{"a.go", "b.txt", "c, d:e", "skip", B3IgnoreFile} {
+		panicOn(os.WriteFile(filepath.Join(data, name), []byte(name), 0600))
+	}
+	panicOn(os.WriteFile(filepath.Join(data, B3IgnoreFile), []byte("skip\n"), 0600))
+
+	// a manifest made with filters and without the ignore
+	// files is diffed against the tree by the same rules,
+	// not by those given to b3 diff.
+	manifest := filepath.Join(root, "m.b3")
+	cfg := &Blake3SummerConfig{}
+	fs := flag.NewFlagSet("b3", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	panicOn(fs.Parse([]string{"-r", "-no-ignore", "-xglob", "*.txt", "-xre", ".*/c, d:e", "-o", manifest, data}))
+	panicOn(cfg.FinishConfig(fs))
+	_, err := DirTreeBlake3Hash(cfg)
+	panicOn(err)
+
+	fd, err := os.Open(manifest)
+	panicOn(err)
+	m, err := ReadManifest(fd)
+	fd.Close()
+	panicOn(err)
+	paths := make(map[string]bool)
+	for _, e := range m.Entries {
+		paths[filepath.Base(e.Path)] = true
+	}
+	if len(paths) != 3 || !paths["a.go"] || !paths["skip"] || !paths[B3IgnoreFile] {
+		t.Fatalf("unexpected manifest paths: %v", paths)
+	}
+
+	diff := &Blake3SummerConfig{}
+	fs = flag.NewFlagSet("b3 diff", flag.ContinueOnError)
+	diff.SetFlags(fs)
+	panicOn(fs.Parse([]string{"-xglob", "*.go"}))
+	panicOn(diff.FinishConfig(fs))
+	d, err := diff.DiffTrees(data, manifest)
+	panicOn(err)
+	if !d.Identical() {
+		t.Fatalf("the tree should not differ from its manifest: %#v", d)
+	}
+}
@@ -0,0 +1,394 @@
+package b3
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DupeGroup is a set of files with identical contents.
+type DupeGroup struct {
+	Sum  string `json:"sum"`
+	Size int64  `json:"size"`
+
+	// Paths are sorted. Hard links to the same file
+	// count once, under the name that sorts first.
+	Paths []string `json:"paths"`
+}
+
+// Wasted is how many bytes the extra copies take up.
+func (g *DupeGroup) Wasted() int64 {
+	return g.Size * int64(len(g.Paths)-1)
+}
+
+// dupeFile is a candidate for FindDupes.
+type dupeFile struct {
+	path string
+	size int64
+}
+
+// FindDupes finds the regular files under targets (each a
+// directory, which is walked recursively, or a file) whose
+// contents are identical, and returns them grouped, the
+// groups wasting the most space first.
+//
+// Only files that share their size with another file are
+// hashed in full, by ScanFiles. With cfg.DupeSample, files
+// that still share a size are first split by a hash of their
+// first and last DupeSample bytes, so that big files which
+// differ near either end are never read through. Files
+// smaller than cfg.DupeMinSize are left out. Files that
+// could not be read are returned in errs.
+func (cfg *Blake3SummerConfig) FindDupes(targets []string) (groups []*DupeGroup, errs []*PathSum, err error) {
+
+	finishCache, err := cfg.useCache()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		err2 := finishCache()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	c2 := *cfg
+	c2.Globs = []string{"*"}
+
+	// size -> files of that size
+	bySize := make(map[int64][]*dupeFile)
+	type inode struct{ dev, ino uint64 }
+	seen := make(map[inode]*dupeFile)
+	seenPath := make(map[string]bool)
+	add := func(path string) {
+		if seenPath[path] {
+			return
+		}
+		seenPath[path] = true
+		fi, err := os.Lstat(path)
+		if err == nil && fi.IsDir() {
+			// scanOneDir passes on the directories it could
+			// not read, for their errors to be reported.
+			_, err = os.ReadDir(path)
+			if err == nil {
+				return
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "b3 error on path '%v': %v\n", path, err)
+			errs = append(errs, &PathSum{Path: path, Err: err})
+			return
+		}
+		if !fi.Mode().IsRegular() || fi.Size() < cfg.DupeMinSize {
+			return
+		}
+		f := &dupeFile{path: path, size: fi.Size()}
+		if dev, ino, _, ok := statIdent(fi); ok {
+			if prev := seen[inode{dev, ino}]; prev != nil {
+				// a hard link; walk order varies, so keep
+				// the name that sorts first.
+				if path < prev.path {
+					prev.path = path
+				}
+				return
+			}
+			seen[inode{dev, ino}] = f
+		}
+		bySize[f.size] = append(bySize[f.size], f)
+	}
+	for _, target := range targets {
+		if dirExists(target) {
+			c2.scanOneDir(target, add)
+		} else {
+			add(target)
+		}
+	}
+
+	// drop the files of unique size, then split the
+	// rest by their samples.
+	var candidates [][]*dupeFile
+	for _, files := range bySize {
+		if len(files) > 1 {
+			candidates = append(candidates, files)
+		}
+	}
+	if cfg.DupeSample > 0 {
+		var sampled [][]*dupeFile
+		candidates, sampled = c2.splitBySample(candidates, &errs)
+		candidates = append(candidates, sampled...)
+	}
+
+	stopProgress := c2.startProgress()
+	defer stopProgress()
+
+	files := make(map[string]bool)
+	sizeOf := make(map[string]int64)
+	for _, group := range candidates {
+		for _, f := range group {
+			files[f.path] = true
+			sizeOf[f.path] = f.size
+			c2.progress.foundFile(f.size)
+		}
+	}
+	c2.progress.walkDone()
+
+	// the sum alone is enough to group by, but keeping
+	// the size in the key costs nothing.
+	type dupeKey struct {
+		size int64
+		sum  string
+	}
+	bySum := make(map[dupeKey]*DupeGroup)
+	results := make(chan *PathSum, 1024)
+	c2.ScanFiles(files, results)
+	for s := range results {
+		if s.Err != nil {
+			fmt.Fprintf(os.Stderr, "b3 error on path '%v': %v\n", s.Path, s.Err)
+			errs = append(errs, s)
+			continue
+		}
+		k := dupeKey{size: sizeOf[s.Path], sum: s.Sum}
+		g := bySum[k]
+		if g == nil {
+			g = &DupeGroup{Sum: s.Sum, Size: k.size}
+			bySum[k] = g
+		}
+		g.Paths = append(g.Paths, s.Path)
+	}
+
+	for _, g := range bySum {
+		if len(g.Paths) > 1 {
+			sort.Strings(g.Paths)
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		wi, wj := groups[i].Wasted(), groups[j].Wasted()
+		if wi != wj {
+			return wi > wj
+		}
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+	return groups, errs, nil
+}
+
+// splitBySample splits each candidate group of same sized
+// files by the sample hash of each file, dropping the files
+// left alone. Groups of files no bigger than two samples are
+// returned unsplit in small, since sampling them would read
+// them in full anyway. Unreadable files are added to errs.
+func (cfg *Blake3SummerConfig) splitBySample(candidates [][]*dupeFile, errs *[]*PathSum) (small, split [][]*dupeFile) {
+
+	var todo []*dupeFile
+	for _, group := range candidates {
+		if group[0].size <= 2*cfg.DupeSample {
+			small = append(small, group)
+			continue
+		}
+		todo = append(todo, group...)
+	}
+
+	sums := make([]string, len(todo))
+	sumErrs := make([]error, len(todo))
+	work := make(chan int, 1024)
+	var wg sync.WaitGroup
+	ngoro := cfg.jobs()
+	wg.Add(ngoro)
+	for i := 0; i < ngoro; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				sums[j], sumErrs[j] = cfg.sampleSum(todo[j].path, todo[j].size)
+			}
+		}()
+	}
+	for j := range todo {
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+
+	type sampleKey struct {
+		size int64
+		sum  string
+	}
+	bySample := make(map[sampleKey][]*dupeFile)
+	for j, f := range todo {
+		if sumErrs[j] != nil {
+			fmt.Fprintf(os.Stderr, "b3 error on path '%v': %v\n", f.path, sumErrs[j])
+			*errs = append(*errs, &PathSum{Path: f.path, Err: sumErrs[j]})
+			continue
+		}
+		k := sampleKey{size: f.size, sum: sums[j]}
+		bySample[k] = append(bySample[k], f)
+	}
+	for _, group := range bySample {
+		if len(group) > 1 {
+			split = append(split, group)
+		}
+	}
+	return
+}
+
+// sampleSum hashes the first and last cfg.DupeSample
+// bytes of path, which should be size bytes long.
+func (cfg *Blake3SummerConfig) sampleSum(path string, size int64) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := cfg.newHasher()
+	buf := make([]byte, cfg.DupeSample)
+	for _, off := range []int64{0, size - cfg.DupeSample} {
+		_, err = fd.ReadAt(buf, off)
+		if err == io.EOF {
+			return "", fmt.Errorf("b3 error: '%v' shrank while we were reading it", path)
+		}
+		if err != nil {
+			return "", err
+		}
+		h.Write(buf)
+	}
+	return cfg.encodeSum(h), nil
+}
+
+// dupesJSON is what b3 dupes -json writes.
+type dupesJSON struct {
+	Groups []*dupeGroupJSON `json:"groups"`
+	Files  int              `json:"files"`
+	Wasted int64            `json:"wasted"`
+	Errors int              `json:"errors"`
+}
+
+type dupeGroupJSON struct {
+	*DupeGroup
+	Wasted int64 `json:"wasted"`
+}
+
+// DupesMain implements "b3 dupes [dir|file ...]".
+// It exits 1 if any file could not be read.
+func DupesMain(args []string) {
+
+	cfg := &Blake3SummerConfig{}
+	fs := flag.NewFlagSet("b3 dupes", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `
+b3 dupes finds files with identical contents under the
+given directories (default: the current directory), and
+prints each group of them with its size and the bytes
+wasted by the extra copies. Only files that share their
+size with another file are hashed.
+
+With -link, each duplicate is replaced with a hard link, or
+a reflink, to the first file of its group, after comparing
+them byte for byte. Give -log to record what is done, so
+that -undo can reverse it later.
+
+usage: b3 dupes [flags] [dir|file ...]
+       b3 dupes -undo logfile [-n]
+
+Flags:
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	cfg.SetFlags(fs)
+	fs.Int64Var(&cfg.DupeSample, "sample", 0, "before hashing same sized files in full, compare a hash of their first and last this many bytes (0: off)")
+	fs.Int64Var(&cfg.DupeMinSize, "minsize", 1, "ignore files smaller than this many bytes")
+	fs.StringVar(&cfg.DupeLink, "link", "", "replace duplicates with links to the first file of their group: "+LinkHard+" or "+LinkReflink)
+	fs.StringVar(&cfg.DupeLog, "log", "", "with -link: append a record of each link made to this file, for -undo")
+	fs.BoolVar(&cfg.DryRun, "n", false, "with -link or -undo: report what would be done, but change nothing")
+	var undo string
+	fs.StringVar(&undo, "undo", "", "give back each duplicate linked in this -log file its own copy, with its permissions and mtime")
+	fs.Parse(args)
+	err := cfg.FinishConfig(fs)
+	if err == nil {
+		switch {
+		case cfg.ModTimeHash || len(cfg.Meta) > 0:
+			err = fmt.Errorf("-mt and -meta do not apply to b3 dupes")
+		case cfg.NDJSON || cfg.OutPath != "" || cfg.CheckPath != "" || cfg.PathListStdin || cfg.SingleFilePath != "":
+			err = fmt.Errorf("-ndjson, -o, -c, -i and -f do not apply to b3 dupes")
+		case cfg.DupeSample < 0:
+			err = fmt.Errorf("-sample cannot be negative")
+		case cfg.DupeLink != "" && cfg.DupeLink != LinkHard && cfg.DupeLink != LinkReflink:
+			err = fmt.Errorf("-link must be %v or %v", LinkHard, LinkReflink)
+		case cfg.DupeLink == LinkReflink && !reflinkSupported:
+			err = fmt.Errorf("-link %v is not supported on this platform", LinkReflink)
+		case (cfg.DupeLink != "" || undo != "") && cfg.JSON:
+			err = fmt.Errorf("-json does not apply with -link or -undo")
+		case cfg.DupeLog != "" && cfg.DupeLink == "":
+			err = fmt.Errorf("-log needs -link")
+		case undo != "" && (cfg.DupeLink != "" || fs.NArg() > 0):
+			err = fmt.Errorf("-undo takes no -link or paths")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "b3 error: command line problem: '%s'\n", err)
+		os.Exit(1)
+	}
+	if cfg.Help {
+		fs.Usage()
+	}
+	cfg.exitUnlessBackground(1)
+	if undo != "" {
+		restored, err := cfg.UndoDedupe(undo, os.Stdout)
+		fmt.Printf("%v files restored\n", restored)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	targets := fs.Args()
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+
+	groups, errs, err := cfg.FindDupes(targets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	var files int
+	var wasted int64
+	for _, g := range groups {
+		files += len(g.Paths)
+		wasted += g.Wasted()
+	}
+
+	if cfg.DupeLink != "" {
+		linked, saved, err := cfg.Dedupe(groups, os.Stdout)
+		fmt.Printf("%v files linked, %v bytes saved\n", linked, saved)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	} else if cfg.JSON {
+		doc := &dupesJSON{Groups: []*dupeGroupJSON{}, Files: files, Wasted: wasted, Errors: len(errs)}
+		for _, g := range groups {
+			doc.Groups = append(doc.Groups, &dupeGroupJSON{DupeGroup: g, Wasted: g.Wasted()})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		panicOn(enc.Encode(doc))
+	} else {
+		for _, g := range groups {
+			fmt.Printf("%v  %v copies of %v bytes, %v bytes wasted\n", g.Sum, len(g.Paths), g.Size, g.Wasted())
+			for _, path := range g.Paths {
+				fmt.Printf("    %v\n", path)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("%v groups, %v files, %v bytes wasted\n", len(groups), files, wasted)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "b3 error: %v file(s) could not be read\n", len(errs))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,154 @@
+package b3
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindDupes_SizeAndSample(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(filepath.Join(root, "sub"), 0700))
+	big := bytes.Repeat([]byte("abcdefgh"), 4096)
+	middle := append([]byte(nil), big...)
+	middle[len(middle)/2] = 'X' // same size, head and tail as big.
+	tail := append([]byte(nil), big...)
+	tail[len(tail)-1] = 'X' // differs in the sample.
+
+	write := func(name string, data []byte) {
+		panicOn(os.WriteFile(filepath.Join(root, name), data, 0600))
+	}
+	write("big1", big)
+	write("sub/big2", big)
+	write("middle", middle)
+	write("tail", tail)
+	write("small1", []byte("small"))
+	write("sub/small2", []byte("small"))
+	write("unique", []byte("unique size"))
+	write("empty1", nil)
+	write("empty2", nil)
+	panicOn(os.Link(filepath.Join(root, "big1"), filepath.Join(root, "big1-link")))
+
+	for _, sample := range []int64{0, 1024} {
+		cfg := &Blake3SummerConfig{DupeSample: sample, DupeMinSize: 1}
+		groups, errs, err := cfg.FindDupes([]string{root})
+		panicOn(err)
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if len(groups) != 2 {
+			t.Fatalf("sample %v: want 2 groups, got %v", sample, len(groups))
+		}
+		// the hard link counts once, under the name that sorts first.
+		want := []string{filepath.Join(root, "big1"), filepath.Join(root, "sub/big2")}
+		if !reflect.DeepEqual(groups[0].Paths, want) {
+			t.Fatalf("sample %v: want %v, got %v", sample, want, groups[0].Paths)
+		}
+		if groups[0].Wasted() != int64(len(big)) {
+			t.Fatalf("sample %v: want %v wasted, got %v", sample, len(big), groups[0].Wasted())
+		}
+		want = []string{filepath.Join(root, "small1"), filepath.Join(root, "sub/small2")}
+		if !reflect.DeepEqual(groups[1].Paths, want) || groups[1].Size != 5 {
+			t.Fatalf("sample %v: unexpected group %#v", sample, groups[1])
+		}
+	}
+}
+
+func TestDedupe_HardlinkAndUndo(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	a := filepath.Join(root, "a")
+	b := filepath.Join(root, "b")
+	c := filepath.Join(root, "c")
+	d := filepath.Join(root, "d")
+	panicOn(os.WriteFile(a, []byte("same"), 0600))
+	panicOn(os.WriteFile(b, []byte("same"), 0600))
+	panicOn(os.WriteFile(c, []byte("same"), 0640)) // mode differs
+	panicOn(os.WriteFile(d, []byte("same"), 0600)) // mtime differs
+	old := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, path := range []string{a, b, c} {
+		panicOn(os.Chtimes(path, old, old))
+	}
+
+	cfg := &Blake3SummerConfig{
+		DupeMinSize: 1,
+		DupeLink:    LinkHard,
+		DupeLog:     filepath.Join(root, "log"),
+	}
+	groups, _, err := cfg.FindDupes([]string{a, b, c, d})
+	panicOn(err)
+
+	cfg.DryRun = true
+	linked, _, err := cfg.Dedupe(groups, io.Discard)
+	panicOn(err)
+	if linked != 1 || fileExists(cfg.DupeLog) {
+		t.Fatalf("dry run: linked %v, or wrote the log", linked)
+	}
+	fa, _ := os.Stat(a)
+	if fb, _ := os.Stat(b); os.SameFile(fa, fb) {
+		t.Fatalf("dry run linked")
+	}
+
+	cfg.DryRun = false
+	linked, saved, err := cfg.Dedupe(groups, io.Discard)
+	panicOn(err)
+	if linked != 1 || saved != 4 {
+		t.Fatalf("want 1 linked and 4 bytes saved, got %v and %v", linked, saved)
+	}
+	fb, _ := os.Stat(b)
+	fc, _ := os.Stat(c)
+	fd, _ := os.Stat(d)
+	if !os.SameFile(fa, fb) || os.SameFile(fa, fc) || os.SameFile(fa, fd) {
+		t.Fatalf("want only b linked to a")
+	}
+
+	restored, err := cfg.UndoDedupe(cfg.DupeLog, io.Discard)
+	panicOn(err)
+	fb, _ = os.Stat(b)
+	if restored != 1 || os.SameFile(fa, fb) || !fb.ModTime().Equal(old) || fb.Mode().Perm() != 0600 {
+		t.Fatalf("undo did not restore b: %v, %v %v", restored, fb.ModTime(), fb.Mode())
+	}
+	data, err := os.ReadFile(b)
+	panicOn(err)
+	if string(data) != "same" {
+		t.Fatalf("undo changed the contents of b to %q", data)
+	}
+}
+
+func TestFindDupes_ReportsUnreadableDir(t *testing.T) {
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	locked := filepath.Join(root, "locked")
+	panicOn(os.MkdirAll(locked, 0700))
+	panicOn(os.WriteFile(filepath.Join(locked, "f"), []byte("f"), 0600))
+	panicOn(os.Chmod(locked, 0))
+	defer os.Chmod(locked, 0700) // so RemoveAll can clean up.
+
+	cfg := &Blake3SummerConfig{DupeMinSize: 1}
+	_, errs, err := cfg.FindDupes([]string{root})
+	panicOn(err)
+	if len(errs) != 1 || errs[0].Path != locked {
+		t.Fatalf("want an error for '%v', got %v", locked, errs)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+
+package b3
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The posix_fadvise advice we give. These values hold
+// for the architectures this file is built on; s390x
+// and the 32-bit ones differ, and get fadvise_other.go.
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// fadvise gives the kernel advice about the n bytes of fd
+// from off; n of 0 means to the end. It is only a hint, so
+// errors are ignored.
+func fadvise(fd *os.File, off, n int64, advice int) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, fd.Fd(), uintptr(off), uintptr(n), uintptr(advice), 0, 0)
+}
+
+// residentPages reports which pages of the first size bytes
+// of fd are in the page cache: one byte per page, with bit 0
+// set if it is (see mincore(2)). Mapping the file reads none
+// of it. It returns nil if we cannot tell.
+func residentPages(fd *os.File, size int64) []byte {
+	if size <= 0 || int64(int(size)) != size {
+		return nil
+	}
+	m, err := syscall.Mmap(int(fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil
+	}
+	defer syscall.Munmap(m)
+	pg := int64(os.Getpagesize())
+	vec := make([]byte, (size+pg-1)/pg)
+	_, _, errno := syscall.Syscall(syscall.SYS_MINCORE, uintptr(unsafe.Pointer(&m[0])), uintptr(size), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return nil
+	}
+	return vec
+}
@@ -0,0 +1,18 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+
+package b3
+
+import (
+	"os"
+)
+
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// fadvise is only a hint, and we give none here.
+func fadvise(fd *os.File, off, n int64, advice int) {}
+
+// residentPages cannot tell here.
+func residentPages(fd *os.File, size int64) []byte { return nil }
@@ -0,0 +1,182 @@
+package b3
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// filterRules are the -glob, -xglob, -re and -xre path
+// filters, in command line order. The last rule to match
+// a path decides if it is kept, so later rules carve
+// exceptions out of earlier ones:
+//
+//	b3 -r -glob '**/*.go' -xglob '**/*_test.go'
+//
+// A path that no rule matches is kept, unless there
+// are any include (-glob or -re) rules.
+type filterRules struct {
+	rules    []*filterRule
+	includes int
+}
+
+type filterRule struct {
+	include bool
+	pattern string
+
+	// exactly one of these is set.
+	glob []string // pattern split on "/"
+	re   *regexp.Regexp
+}
+
+// filterFlag adds rules of one kind to a shared
+// filterRules, so that the order of different
+// flags on the command line is kept.
+type filterFlag struct {
+	rules   *filterRules
+	include bool
+	isRegex bool
+}
+
+func (f *filterFlag) String() string {
+	if f.rules == nil {
+		return ""
+	}
+	var pats []string
+	for _, r := range f.rules.rules {
+		if r.include == f.include && (r.re != nil) == f.isRegex {
+			pats = append(pats, r.pattern)
+		}
+	}
+	return strings.Join(pats, ",")
+}
+
+// the flags package will call Set(), in command line
+// order, once for each -glob, -xglob, -re or -xre.
+func (f *filterFlag) Set(value string) error {
+	r := &filterRule{include: f.include, pattern: value}
+	if f.isRegex {
+		// anchored: the regex must match the whole path.
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return fmt.Errorf("bad regex '%v': %v", value, err)
+		}
+		r.re = re
+	} else {
+		r.glob = strings.Split(value, "/")
+		for _, seg := range r.glob {
+			if _, err := path.Match(seg, ""); err != nil {
+				return fmt.Errorf("bad glob '%v': %v", value, err)
+			}
+		}
+	}
+	f.rules.rules = append(f.rules.rules, r)
+	if r.include {
+		f.rules.includes++
+	}
+	return nil
+}
+
+// flagName is the command line flag that makes r.
+func (r *filterRule) flagName() string {
+	name := "glob"
+	if r.re != nil {
+		name = "re"
+	}
+	if !r.include {
+		name = "x" + name
+	}
+	return name
+}
+
+// encode gives the rules as one string, for the manifest
+// header: a "flag:pattern" line per rule, in order.
+func (fr *filterRules) encode() string {
+	var lines []string
+	for _, r := range fr.rules {
+		lines = append(lines, r.flagName()+":"+r.pattern)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// decodeFilterRules undoes filterRules.encode.
+func decodeFilterRules(s string) (fr filterRules, err error) {
+	if s == "" {
+		return
+	}
+	for _, line := range strings.Split(s, "\n") {
+		name, pattern, _ := strings.Cut(line, ":")
+		f := &filterFlag{rules: &fr}
+		switch name {
+		case "glob":
+			f.include = true
+		case "xglob":
+		case "re":
+			f.include, f.isRegex = true, true
+		case "xre":
+			f.isRegex = true
+		default:
+			return fr, fmt.Errorf("unknown filter '%v'", line)
+		}
+		err = f.Set(pattern)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// keep reports if path survives the rules.
+func (fr *filterRules) keep(p string) bool {
+	p = strings.TrimPrefix(path.Clean(p), "./")
+	for i := len(fr.rules) - 1; i >= 0; i-- {
+		if fr.rules[i].match(p) {
+			return fr.rules[i].include
+		}
+	}
+	return fr.includes == 0
+}
+
+// match reports if the rule's pattern matches p. A glob
+// with no "/" in it matches the final name in p, like
+// .gitignore does; otherwise it must match all of p, with
+// "**" matching any number of directories.
+func (r *filterRule) match(p string) bool {
+	if r.re != nil {
+		return r.re.MatchString(p)
+	}
+	if len(r.glob) == 1 {
+		ok, _ := path.Match(r.glob[0], path.Base(p))
+		return ok
+	}
+	return matchSegments(r.glob, strings.Split(p, "/"))
+}
+
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			// collapse runs of **, then try every split.
+			for len(pat) > 1 && pat[1] == "**" {
+				pat = pat[1:]
+			}
+			if len(pat) == 1 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,60 @@
+package b3
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestFilterRules_LastMatchWins(t *testing.T) {
+
+	cfg := &Blake3SummerConfig{}
+	fs := flag.NewFlagSet("b3", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	panicOn(fs.Parse([]string{
+		"-glob", "**/*.go",
+		"-xglob", "**/*_test.go",
+		"-re", `vendor/.*keep_test\.go`,
+		"-xglob", "foo.golden/**",
+	}))
+
+	for path, want := range map[string]bool{
+		"main.go":                        true,
+		"./cmd/b3/main.go":               true,
+		"/abs/dir/x.go":                  true,
+		"b3_test.go":                     false,
+		"vendor/a/keep_test.go":          true,
+		"foo.golden/x.go":                false,
+		"src.gold":                       false, // no include rule matches
+		"a.go/README":                    false,
+		"deep/ly/nested/pkg/thing_go.go": true,
+	} {
+		if got := cfg.Filters.keep(path); got != want {
+			t.Fatalf("keep('%v') = %v, want %v", path, got, want)
+		}
+	}
+
+	// as recorded in a manifest header, they come back
+	// the same, in the same order.
+	fr, err := decodeFilterRules(cfg.Filters.encode())
+	panicOn(err)
+	if got, want := fr.encode(), cfg.Filters.encode(); got != want || fr.includes != 2 {
+		t.Fatalf("filters came back as '%v', want '%v'", got, want)
+	}
+
+	// with only excludes, unmatched paths are kept.
+	cfg = &Blake3SummerConfig{}
+	fs = flag.NewFlagSet("b3", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	panicOn(fs.Parse([]string{"-xre", `.*\.(tmp|bak)`}))
+	if !cfg.Filters.keep("a/b.go") || cfg.Filters.keep("a/b.bak") {
+		t.Fatalf("exclude-only rules went wrong")
+	}
+
+	fs = flag.NewFlagSet("b3", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	fs.SetOutput(io.Discard)
+	if fs.Parse([]string{"-glob", "[unclosed"}) == nil {
+		t.Fatalf("expected error on a bad glob")
+	}
+}
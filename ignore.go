@@ -0,0 +1,238 @@
+package b3
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// B3IgnoreFile is read from every directory b3 walks
+// unless -no-ignore is given. It uses .gitignore syntax.
+const B3IgnoreFile = ".b3ignore"
+
+// GitIgnoreFile is also read, with b3 -gitignore.
+const GitIgnoreFile = ".gitignore"
+
+// Ignorer decides which paths the ignore files (like
+// .gitignore) in their directories, or in any parent
+// directory, say to leave out. Ignore files are read
+// hierarchically, as git does: deeper files take precedence
+// over shallower ones, and within a file the last matching
+// pattern wins. We look upward from each path, as it is
+// spelled, until we reach a walk root (see AddRoot), the top
+// of a git repository (a directory holding .git), or failing
+// those, the current directory or the root of the filesystem.
+// Ignore files above the walk are never read.
+//
+// An Ignorer caches the ignore files it reads, and for each
+// directory, the ones that apply to it, so that most paths
+// cost one lookup, and none at all to match when there are
+// no ignore files. It is safe for concurrent use.
+type Ignorer struct {
+	// Names are the ignore files to read from each
+	// directory, in increasing order of precedence.
+	Names []string
+
+	// SkipGit leaves out .git directories entirely.
+	SkipGit bool
+
+	mut   sync.RWMutex
+	dirs  map[string]*ignoreDir
+	roots map[string]bool
+}
+
+// ignoreDir holds what the ignore files in one
+// directory say.
+type ignoreDir struct {
+	patterns []*ignorePattern
+
+	// prefix is the directory's path with a "/" after
+	// it, to strip from the paths below it ("" for ".").
+	prefix string
+
+	// chain holds the directories, from the walk root
+	// down to and including this one, that have
+	// patterns; nil if none do.
+	chain []*ignoreDir
+}
+
+type ignorePattern struct {
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	glob     []string // split on "/"
+}
+
+// NewIgnorer returns an Ignorer that reads the
+// named ignore files.
+func NewIgnorer(names ...string) *Ignorer {
+	return &Ignorer{
+		Names: names,
+		dirs:  make(map[string]*ignoreDir),
+		roots: make(map[string]bool),
+	}
+}
+
+// AddRoot says a walk starts at dir, so no ignore files
+// above it are read, unless it is under a root already.
+// Call it before the walk asks about anything under dir.
+func (ig *Ignorer) AddRoot(dir string) {
+	dir = path.Clean(filepath.ToSlash(dir))
+	ig.mut.Lock()
+	defer ig.mut.Unlock()
+	for d := dir; ; d = path.Dir(d) {
+		if ig.roots[d] {
+			return
+		}
+		if isTopDir(d) {
+			break
+		}
+	}
+	ig.roots[dir] = true
+}
+
+// Ignored reports if path is ignored by the patterns in
+// the ignore files above it. isDir says if path is a
+// directory, for patterns that end in "/". Paths under an
+// ignored directory are not reported as ignored themselves;
+// walks should not descend into ignored directories.
+func (ig *Ignorer) Ignored(p string, isDir bool) bool {
+	p = path.Clean(filepath.ToSlash(p))
+	d := ig.load(path.Dir(p))
+	if d.chain == nil {
+		return false
+	}
+	// top down, so that deeper files win.
+	ignored := false
+	for _, c := range d.chain {
+		rel := strings.TrimPrefix(p, c.prefix)
+		for _, pat := range c.patterns {
+			if pat.match(rel, isDir) {
+				ignored = !pat.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// load reads (once) the ignore files in dir, and
+// works out the chain of those that apply to it.
+func (ig *Ignorer) load(dir string) *ignoreDir {
+	ig.mut.RLock()
+	d, ok := ig.dirs[dir]
+	ig.mut.RUnlock()
+	if ok {
+		return d
+	}
+	ig.mut.Lock()
+	defer ig.mut.Unlock()
+	return ig.loadLocked(dir)
+}
+
+func (ig *Ignorer) loadLocked(dir string) *ignoreDir {
+	if d, ok := ig.dirs[dir]; ok {
+		return d
+	}
+	d := &ignoreDir{prefix: dir + "/"}
+	switch dir {
+	case ".":
+		d.prefix = ""
+	case "/":
+		d.prefix = "/"
+	}
+	for _, name := range ig.Names {
+		d.patterns = append(d.patterns, readIgnoreFile(path.Join(dir, name))...)
+	}
+	top := ig.roots[dir] || isTopDir(dir)
+	if !top {
+		if _, err := os.Lstat(path.Join(dir, ".git")); err == nil {
+			top = true
+		}
+	}
+	if !top {
+		d.chain = ig.loadLocked(path.Dir(dir)).chain
+	}
+	if len(d.patterns) > 0 {
+		d.chain = append(d.chain[:len(d.chain):len(d.chain)], d)
+	}
+	ig.dirs[dir] = d
+	return d
+}
+
+// isTopDir reports if we cannot look above dir, going by
+// its path alone: it is the current directory, the root,
+// or has ".." at the end (whose parent is not path.Dir).
+func isTopDir(dir string) bool {
+	return dir == "." || dir == "/" || path.Base(dir) == ".."
+}
+
+// readIgnoreFile parses a file in .gitignore syntax.
+// A missing or unreadable file has no patterns.
+func readIgnoreFile(name string) (patterns []*ignorePattern) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if p := parseIgnoreLine(scanner.Text()); p != nil {
+			patterns = append(patterns, p)
+		}
+	}
+	return
+}
+
+func parseIgnoreLine(line string) *ignorePattern {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	p := &ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	// a "/" anywhere but the end anchors the pattern
+	// to the directory of the ignore file.
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+	p.glob = strings.Split(line, "/")
+	for _, seg := range p.glob {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil
+		}
+	}
+	return p
+}
+
+// match reports if the pattern matches rel, a path
+// relative to the directory of the pattern's ignore file.
+func (p *ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.glob[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(p.glob, strings.Split(rel, "/"))
+}
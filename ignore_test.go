@@ -0,0 +1,100 @@
+package b3
+
+import (
+	"iter"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIgnorer_Hierarchical(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{".git/objects", "build", "src/gen", "src/sub"} {
+		panicOn(os.MkdirAll(filepath.Join(root, dir), 0700))
+	}
+	for _, file := range []string{".git/objects/x", "build/out.o", "src/a.go", "src/a.o", "src/gen/z.go", "src/sub/keep.o", "README"} {
+		panicOn(os.WriteFile(filepath.Join(root, file), nil, 0600))
+	}
+	panicOn(os.WriteFile(filepath.Join(root, ".gitignore"), []byte("# built\nbuild/\n*.o\n!keep.o\n"), 0600))
+	panicOn(os.WriteFile(filepath.Join(root, "src", ".b3ignore"), []byte("/gen/\n"), 0600))
+
+	walk := func(ig *Ignorer, only bool) string {
+		di := NewDirIter()
+		di.Ignore = ig
+		di.OnlyIgnored = only
+		next, stop := iter.Pull2(di.FilesOnly(root))
+		defer stop()
+		var got []string
+		for {
+			path, ok, valid := next()
+			if !valid {
+				break
+			}
+			if ok {
+				got = append(got, strings.TrimPrefix(path, root+"/"))
+			}
+		}
+		sort.Strings(got)
+		return strings.Join(got, " ")
+	}
+
+	ig := NewIgnorer(GitIgnoreFile, B3IgnoreFile)
+	ig.SkipGit = true
+	if got, want := walk(ig, false), ".gitignore README src/.b3ignore src/a.go src/sub/keep.o"; got != want {
+		t.Fatalf("kept: want '%v', got '%v'", want, got)
+	}
+	if got, want := walk(ig, true), "build/out.o src/a.o src/gen/z.go"; got != want {
+		t.Fatalf("ignored: want '%v', got '%v'", want, got)
+	}
+
+	// .b3ignore alone leaves the .gitignore patterns out of it.
+	if got, want := walk(NewIgnorer(B3IgnoreFile), false), ".git/objects/x .gitignore README build/out.o src/.b3ignore src/a.go src/a.o src/sub/keep.o"; got != want {
+		t.Fatalf(".b3ignore only: want '%v', got '%v'", want, got)
+	}
+}
+
+func TestIgnorer_StopsAtWalkRoot(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(filepath.Join(root, "tree", "sub"), 0700))
+	panicOn(os.WriteFile(filepath.Join(root, ".b3ignore"), []byte("*.o\n"), 0600))
+	panicOn(os.WriteFile(filepath.Join(root, "tree", ".b3ignore"), []byte("*.tmp\n"), 0600))
+
+	// without a root, the ignore file above the tree counts.
+	ig := NewIgnorer(B3IgnoreFile)
+	if !ig.Ignored(filepath.Join(root, "tree", "sub", "a.o"), false) {
+		t.Fatalf("want a.o ignored by the parent's .b3ignore")
+	}
+
+	// walking from tree, it is never read.
+	ig = NewIgnorer(B3IgnoreFile)
+	ig.AddRoot(filepath.Join(root, "tree"))
+	ig.AddRoot(filepath.Join(root, "tree", "sub")) // under a root already
+	if ig.Ignored(filepath.Join(root, "tree", "sub", "a.o"), false) {
+		t.Fatalf("read a .b3ignore above the walk root")
+	}
+	if !ig.Ignored(filepath.Join(root, "tree", "sub", "a.tmp"), false) {
+		t.Fatalf("want a.tmp ignored by the walk root's .b3ignore")
+	}
+	if _, ok := ig.dirs[root]; ok {
+		t.Fatalf("loaded the directory above the walk root")
+	}
+
+	// with no ignore files at all, nothing is matched.
+	ig = NewIgnorer(GitIgnoreFile)
+	ig.AddRoot(root)
+	if ig.Ignored(filepath.Join(root, "tree", "x"), false) || ig.load(filepath.Join(root, "tree")).chain != nil {
+		t.Fatalf("no .gitignore, but something to match")
+	}
+}
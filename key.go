@@ -0,0 +1,125 @@
+package b3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/glycerine/blake3"
+)
+
+// KeyLen is the length in bytes of a key for
+// BLAKE3's keyed hash mode, as used by b3 -key.
+const KeyLen = 32
+
+// loadKeyFile reads a key for b3 -key. The file holds
+// either exactly KeyLen raw bytes, or 2*KeyLen hex digits
+// (surrounding whitespace, like a trailing newline, is ok).
+func loadKeyFile(path string) (key []byte, err error) {
+	by, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("b3 error reading key file '%v': %v", path, err)
+	}
+	if len(by) == KeyLen {
+		return by, nil
+	}
+	txt := string(bytes.TrimSpace(by))
+	if len(txt) == 2*KeyLen {
+		key, err = hex.DecodeString(txt)
+		if err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("b3 error: key file '%v' must hold %v raw bytes or %v hex digits", path, KeyLen, 2*KeyLen)
+}
+
+// initKey sets the key we hash with: derived from
+// cfg.Context and cfg.keyMaterial with BLAKE3's derive_key
+// mode when there is a context, or else keyMaterial itself.
+//
+// Files are then hashed in keyed mode with that key. This
+// is not b3sum --derive-key, which hashes its input as the
+// key material itself: blake3 offers derive_key only for
+// short key material held in memory, not for files. Keyed
+// mode with the derived key gives the same separation, in
+// that sums under different contexts (or keys) never match,
+// but different sums.
+func (cfg *Blake3SummerConfig) initKey() {
+	if cfg.Context == "" {
+		cfg.key = cfg.keyMaterial
+		return
+	}
+	cfg.key = make([]byte, KeyLen)
+	blake3.DeriveKey(cfg.key, cfg.Context, cfg.keyMaterial)
+}
+
+// newHasher returns a blake3 Hasher for sums
+// and hashes of hashes, keyed if we have a key.
+func (cfg *Blake3SummerConfig) newHasher() *blake3.Hasher {
+	return blake3.New(64, cfg.key)
+}
+
+// keyID identifies the key from -key without revealing it,
+// so that manifests and the hash cache can record which key
+// made their sums. It is "" when we have no key.
+func (cfg *Blake3SummerConfig) keyID() string {
+	if cfg.keyMaterial == nil {
+		return ""
+	}
+	h := blake3.New(32, cfg.keyMaterial)
+	h.Write([]byte("b3 key id"))
+	return fmt.Sprintf("%x", h.Sum(nil)[:8])
+}
+
+// keying is what goes after "blake3" in our sum labels
+// (and after the version in tree labels): "d" for derived
+// key sums (-context), "k" for keyed sums (-key), or "".
+func (cfg *Blake3SummerConfig) keying() string {
+	switch {
+	case cfg.Context != "":
+		return "d"
+	case cfg.key != nil:
+		return "k"
+	}
+	return ""
+}
+
+// sumKeying returns the keying of sum s, from its label.
+func sumKeying(s string) string {
+	switch {
+	case strings.HasPrefix(s, "blake3k."):
+		return "k"
+	case strings.HasPrefix(s, "blake3d."):
+		return "d"
+	case isTreeSum(s):
+		rest := strings.TrimLeft(s[len("b3tree"):], "0123456789")
+		if len(rest) > 1 && rest[1] == '.' {
+			return rest[:1]
+		}
+	case isDirSum(s):
+		rest := s[len("b3dir"):]
+		if len(rest) > 1 && rest[1] == '.' {
+			return rest[:1]
+		}
+	}
+	return ""
+}
+
+// checkKeying returns an error if sum, from the manifest
+// or listing named by name, was made with a different
+// keying than we would use.
+func (cfg *Blake3SummerConfig) checkKeying(name, sum string) error {
+	got := sumKeying(sum)
+	if got == cfg.keying() {
+		return nil
+	}
+	switch got {
+	case "k":
+		return fmt.Errorf("b3 error: '%v' has keyed sums; give the key with -key", name)
+	case "d":
+		return fmt.Errorf("b3 error: '%v' has derived key sums; give the same -context (and -key, if one was used)", name)
+	}
+	return fmt.Errorf("b3 error: '%v' has unkeyed sums, but -key or -context was given", name)
+}
@@ -0,0 +1,96 @@
+package b3
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyedSums(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	a := filepath.Join(root, "a")
+	panicOn(os.WriteFile(a, []byte("a"), 0600))
+
+	keyFile := filepath.Join(root, "key")
+	panicOn(os.WriteFile(keyFile, []byte(strings.Repeat("0f", KeyLen)+"\n"), 0600))
+	key, err := loadKeyFile(keyFile)
+	panicOn(err)
+	if len(key) != KeyLen || key[0] != 0x0f {
+		t.Fatalf("hex key not decoded: %x", key)
+	}
+
+	plain := &Blake3SummerConfig{Quiet: true}
+	keyed := &Blake3SummerConfig{Quiet: true, keyMaterial: key}
+	keyed.initKey()
+	sumPlain, err := plain.Blake3OfFile(a)
+	panicOn(err)
+	sumKeyed, err := keyed.Blake3OfFile(a)
+	panicOn(err)
+	if !strings.HasPrefix(sumKeyed, "blake3k.33B-") || sumKeyed[8:] == sumPlain[7:] {
+		t.Fatalf("keyed sum '%v' not distinct from '%v'", sumKeyed, sumPlain)
+	}
+
+	manifest := filepath.Join(root, "manifest.b3")
+	panicOn(keyed.WriteManifestFile(manifest, []*PathSum{{Path: a, Sum: sumKeyed}}, sumKeyed))
+
+	bad, err := keyed.CheckManifest(manifest)
+	if err != nil || bad != 0 {
+		t.Fatalf("expected clean keyed verify, got bad=%v err='%v'", bad, err)
+	}
+	_, err = plain.CheckManifest(manifest)
+	if err == nil {
+		t.Fatalf("expected error verifying keyed sums without the key")
+	}
+	other := &Blake3SummerConfig{Quiet: true, keyMaterial: make([]byte, KeyLen)}
+	other.initKey()
+	_, err = other.CheckManifest(manifest)
+	if err == nil {
+		t.Fatalf("expected error verifying keyed sums with the wrong key")
+	}
+}
+
+func TestContextFromManifestHeader(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	a := filepath.Join(root, "a")
+	panicOn(os.WriteFile(a, []byte("a"), 0600))
+
+	acme := &Blake3SummerConfig{Quiet: true, Context: "acme backups 2026 v1"}
+	acme.initKey()
+	other := &Blake3SummerConfig{Quiet: true, Context: "other team"}
+	other.initKey()
+
+	sumAcme, err := acme.Blake3OfFile(a)
+	panicOn(err)
+	sumOther, err := other.Blake3OfFile(a)
+	panicOn(err)
+	if !strings.HasPrefix(sumAcme, "blake3d.33B-") || sumAcme == sumOther {
+		t.Fatalf("contexts not separated: '%v' vs '%v'", sumAcme, sumOther)
+	}
+
+	manifest := filepath.Join(root, "manifest.b3")
+	panicOn(acme.WriteManifestFile(manifest, []*PathSum{{Path: a, Sum: sumAcme}}, sumAcme))
+
+	// no -context given: it comes from the manifest header.
+	plain := &Blake3SummerConfig{Quiet: true}
+	bad, err := plain.CheckManifest(manifest)
+	if err != nil || bad != 0 {
+		t.Fatalf("expected clean verify, got bad=%v err='%v'", bad, err)
+	}
+	_, err = other.CheckManifest(manifest)
+	if err == nil {
+		t.Fatalf("expected error verifying with a different -context")
+	}
+}
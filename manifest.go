@@ -0,0 +1,339 @@
+package b3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ManifestVersion is the version of the manifest
+// format written by b3 -o.
+//
+// A manifest starts with a header line giving the format
+// version and the options that affect the sums, as
+// space separated key=value pairs with URL-escaped values:
+//
+//	#b3-manifest v1 label=blake3.33B- len=33 mt=false tree=0 x=_ xs=~ root=data%2F ignore=b3ignore
+//
+// root is the directory the paths are under; see manifestRoot.
+// ignore names the ignore files honored (see ignoreFiles), and
+// ignored=true and filter (see filterRules.encode) record
+// -ignored and the -glob, -xglob, -re and -xre rules, if any,
+// so that b3 -c and b3 diff choose paths the same way.
+// Manifests of keyed sums (b3 -key) also record keyid,
+// a fingerprint of the key; see keyID. With b3 -context,
+// the context is recorded too, and b3 prints this header
+// line first in its usual output, so that b3 -c finds the
+// context without being told. The same goes for b3 -meta,
+// whose metadata digests follow the sum on each line, after
+// a single space:
+//
+//	blake3.33B-... b3meta.33B-...   path
+//
+// Then comes one "sum   path" line per file, always sum
+// first, in sorted path order. With b3 -dirs, directories
+// get a line each too, their path ending in "/", with a
+// "b3dir" sum; see sumDirEntries. A path containing a newline
+// or a backslash has them escaped as \n and \\, and its
+// line starts with a backslash (as b3sum and sha256sum do).
+// The last line holds the hash of hashes:
+//
+//	#b3-top blake3.33B-...
+const ManifestVersion = 1
+
+const (
+	manifestMagic  = "#b3-manifest"
+	manifestTopTag = "#b3-top "
+)
+
+// Manifest is a parsed manifest, or any other b3 output.
+type Manifest struct {
+	// Version is 0 if there was no header line.
+	Version int
+
+	// Header holds the key=value options from the
+	// header line: label, len, mt, tree, x, xs, root,
+	// ignore, ignored, filter, seek, context, meta,
+	// dirs, keyid.
+	Header map[string]string
+
+	Entries []*ManifestEntry
+
+	// Top is the hash of hashes, if it was recorded.
+	Top string
+}
+
+// manifestHeader describes the options that
+// affect the sums we are about to write.
+func (cfg *Blake3SummerConfig) manifestHeader() string {
+	label := cfg.sumLabel()
+	if label == "" {
+		label = "hex"
+	}
+	kv := []string{
+		"label", label,
+		"len", strconv.Itoa(cfg.sumLen()),
+		"mt", strconv.FormatBool(cfg.ModTimeHash),
+		"tree", strconv.Itoa(cfg.TreeVersion),
+		"x", strings.Join(cfg.Xprefix.x, ","),
+		"xs", strings.Join(cfg.Xsuffix.x, ","),
+		"root", cfg.manifestRoot(),
+		"ignore", cfg.ignoreFiles(),
+	}
+	if cfg.OnlyIgnored {
+		kv = append(kv, "ignored", "true")
+	}
+	if len(cfg.Filters.rules) > 0 {
+		kv = append(kv, "filter", cfg.Filters.encode())
+	}
+	if cfg.Seek > 0 {
+		kv = append(kv, "seek", strconv.FormatInt(cfg.Seek, 10))
+	}
+	if cfg.Context != "" {
+		kv = append(kv, "context", cfg.Context)
+	}
+	if len(cfg.Meta) > 0 {
+		kv = append(kv, "meta", strings.Join(cfg.Meta, ","))
+	}
+	if cfg.Dirs {
+		kv = append(kv, "dirs", "true")
+	}
+	if id := cfg.keyID(); id != "" {
+		kv = append(kv, "keyid", id)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v v%v", manifestMagic, ManifestVersion)
+	for i := 0; i < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], url.QueryEscape(kv[i+1]))
+	}
+	return b.String()
+}
+
+// ignoreFiles names the ignore files honored, for the
+// manifest header: none (-no-ignore), b3ignore, or
+// gitignore (-gitignore, which reads both).
+func (cfg *Blake3SummerConfig) ignoreFiles() string {
+	switch {
+	case cfg.NoIgnore:
+		return "none"
+	case cfg.GitIgnore:
+		return "gitignore"
+	}
+	return "b3ignore"
+}
+
+// manifestRoot is the directory that the paths in a manifest
+// are under, for b3 diff to strip, as it strips the directory
+// it walks on the other side. That is the target itself when
+// it is a single directory (b3 -r -o m.b3 data), else treeRoot.
+func (cfg *Blake3SummerConfig) manifestRoot() string {
+	if len(cfg.Globs) == 1 && !cfg.PathListStdin && dirExists(cfg.Globs[0]) {
+		switch root := filepath.Clean(cfg.Globs[0]); root {
+		case ".":
+			return ""
+		case "/":
+			return "/"
+		default:
+			return root + "/"
+		}
+	}
+	return cfg.treeRoot()
+}
+
+// WriteManifest writes sums, then top, in the manifest format.
+func (cfg *Blake3SummerConfig) WriteManifest(w io.Writer, sums []*PathSum, top string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, cfg.manifestHeader())
+	for _, s := range sums {
+		path, escaped := escapeManifestPath(s.Path)
+		if escaped {
+			bw.WriteString(`\`)
+		}
+		fmt.Fprintf(bw, "%v   %v\n", sumField(s), path)
+	}
+	fmt.Fprintf(bw, "%v%v\n", manifestTopTag, top)
+	return bw.Flush()
+}
+
+// WriteManifestFile writes the manifest to path atomically:
+// readers see either the previous file or the complete new one.
+func (cfg *Blake3SummerConfig) WriteManifestFile(path string, sums []*PathSum, top string) error {
+	err := writeFileAtomic(path, func(fd *os.File) error {
+		err := fd.Chmod(0644)
+		if err != nil {
+			return err
+		}
+		return cfg.WriteManifest(fd, sums, top)
+	})
+	if err != nil {
+		return fmt.Errorf("b3 error writing manifest '%v': %v", path, err)
+	}
+	return nil
+}
+
+func escapeManifestPath(path string) (string, bool) {
+	if !strings.ContainsAny(path, "\n\\") {
+		return path, false
+	}
+	path = strings.ReplaceAll(path, `\`, `\\`)
+	path = strings.ReplaceAll(path, "\n", `\n`)
+	return path, true
+}
+
+func unescapeManifestPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+1 < len(path) {
+			i++
+			switch path[i] {
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(path[i])
+			}
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// printHeader starts our text output with the manifest
+// header, when there is a -context or -meta to record.
+func (cfg *Blake3SummerConfig) printHeader() {
+	if cfg.Context != "" || len(cfg.Meta) > 0 {
+		fmt.Println(cfg.manifestHeader())
+	}
+}
+
+// parseManifestHeader parses a "#b3-manifest v1 k=v ..." line.
+func parseManifestHeader(line string, m *Manifest) error {
+	fields := strings.Fields(strings.TrimPrefix(line, manifestMagic))
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "v") {
+		return fmt.Errorf("b3 error: bad manifest header: '%v'", line)
+	}
+	v, err := strconv.Atoi(fields[0][1:])
+	if err != nil {
+		return fmt.Errorf("b3 error: bad manifest header: '%v'", line)
+	}
+	if v > ManifestVersion {
+		return fmt.Errorf("b3 error: manifest format v%v is newer than this b3 (v%v); please upgrade", v, ManifestVersion)
+	}
+	m.Version = v
+	m.Header = make(map[string]string)
+	for _, kv := range fields[1:] {
+		k, val, _ := strings.Cut(kv, "=")
+		val, err = url.QueryUnescape(val)
+		if err != nil {
+			return fmt.Errorf("b3 error: bad manifest header field '%v': %v", kv, err)
+		}
+		m.Header[k] = val
+	}
+	return nil
+}
+
+// applyManifestHeader sets the options recorded in a
+// manifest header on cfg, so that re-hashing gives
+// comparable sums.
+func (cfg *Blake3SummerConfig) applyManifestHeader(m *Manifest) error {
+	if m.Version == 0 {
+		return nil
+	}
+	err := cfg.applyManifestListing(m)
+	if err != nil {
+		return err
+	}
+	if mt, ok := m.Header["mt"]; ok {
+		b, err := strconv.ParseBool(mt)
+		if err != nil {
+			return fmt.Errorf("b3 error: bad mt=%v in manifest header", mt)
+		}
+		cfg.ModTimeHash = b
+	}
+	if meta, ok := m.Header["meta"]; ok {
+		cfg.Meta = nil
+		err := (*metaFlag)(&cfg.Meta).Set(meta)
+		if err != nil {
+			return fmt.Errorf("b3 error: bad meta=%v in manifest header: %v", meta, err)
+		}
+	}
+	if ctx, ok := m.Header["context"]; ok {
+		if cfg.Context != "" && cfg.Context != ctx {
+			return fmt.Errorf("b3 error: manifest was made with -context %q, not %q", ctx, cfg.Context)
+		}
+		cfg.Context = ctx
+		cfg.initKey()
+	}
+	if id, ok := m.Header["keyid"]; ok {
+		switch cfg.keyID() {
+		case id:
+		case "":
+			return fmt.Errorf("b3 error: manifest has keyed sums; give the key with -key")
+		default:
+			return fmt.Errorf("b3 error: manifest was made with a different key (keyid %v, not %v)", id, cfg.keyID())
+		}
+	}
+	return nil
+}
+
+// applyManifestListing sets the rules that chose which paths
+// went into a manifest on cfg: -x and -xs, -dirs, the -glob,
+// -xglob, -re and -xre filters, and the ignore files. A walk with
+// cfg then lists the same paths, if the tree is unchanged.
+// Rules the header does not record are left as they are;
+// but dirs=true is only written with -dirs, so cfg.Dirs is
+// always set.
+func (cfg *Blake3SummerConfig) applyManifestListing(m *Manifest) error {
+	if m.Version == 0 {
+		return nil
+	}
+	if x, ok := m.Header["x"]; ok {
+		cfg.Xprefix.x = splitList(x)
+	}
+	if xs, ok := m.Header["xs"]; ok {
+		cfg.Xsuffix.x = splitList(xs)
+	}
+	cfg.HasExcludes = len(cfg.Xprefix.x) > 0 || len(cfg.Xsuffix.x) > 0
+
+	// dirs is only recorded when true.
+	cfg.Dirs = m.Header["dirs"] == "true"
+
+	if filter, ok := m.Header["filter"]; ok {
+		fr, err := decodeFilterRules(filter)
+		if err != nil {
+			return fmt.Errorf("b3 error: bad filter in manifest header: %v", err)
+		}
+		cfg.Filters = fr
+	}
+	if ignore, ok := m.Header["ignore"]; ok {
+		switch ignore {
+		case "none":
+			cfg.NoIgnore, cfg.GitIgnore = true, false
+		case "b3ignore":
+			cfg.NoIgnore, cfg.GitIgnore = false, false
+		case "gitignore":
+			cfg.NoIgnore, cfg.GitIgnore = false, true
+		default:
+			return fmt.Errorf("b3 error: bad ignore=%v in manifest header", ignore)
+		}
+		cfg.OnlyIgnored = m.Header["ignored"] == "true"
+		err := cfg.setIgnorer()
+		if err != nil {
+			return fmt.Errorf("b3 error: bad ignore settings in manifest header: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated header value.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,201 @@
+package b3
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The file metadata that b3 -meta can hash, in the
+// order they go into the metadata digest.
+const (
+	// MetaMode is the permission bits, plus setuid,
+	// setgid and sticky, and the file type.
+	MetaMode = "mode"
+
+	// MetaOwner is the owning user and group, by name,
+	// so that it compares across machines whose numeric
+	// ids differ.
+	MetaOwner = "owner"
+
+	// MetaUID is the numeric owning uid and gid.
+	MetaUID = "uid"
+
+	// MetaXattr is every extended attribute, except
+	// for the POSIX ACLs.
+	MetaXattr = "xattr"
+
+	// MetaACL is the POSIX access and default ACLs.
+	MetaACL = "acl"
+)
+
+var metaFields = []string{MetaMode, MetaOwner, MetaUID, MetaXattr, MetaACL}
+
+// the xattrs that hold POSIX ACLs on Linux.
+var aclXattrs = map[string]bool{
+	"system.posix_acl_access":  true,
+	"system.posix_acl_default": true,
+}
+
+// metaFlag is the -meta flag: a comma separated
+// list of metaFields, kept in canonical order.
+type metaFlag []string
+
+func (m *metaFlag) String() string {
+	if m == nil {
+		return ""
+	}
+	return strings.Join(*m, ",")
+}
+
+func (m *metaFlag) Set(value string) error {
+	want := make(map[string]bool)
+	for _, f := range *m {
+		want[f] = true
+	}
+	for _, f := range strings.Split(value, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !isMetaField(f) {
+			return fmt.Errorf("unknown -meta field '%v'; choose from %v", f, strings.Join(metaFields, ","))
+		}
+		want[f] = true
+	}
+	*m = nil
+	for _, f := range metaFields {
+		if want[f] {
+			*m = append(*m, f)
+		}
+	}
+	return nil
+}
+
+func isMetaField(f string) bool {
+	for _, g := range metaFields {
+		if f == g {
+			return true
+		}
+	}
+	return false
+}
+
+// metaDigest hashes the -meta fields of path, whose Lstat
+// info is fi, into a digest kept apart from the content
+// sum, so that content sums still compare across machines.
+func (cfg *Blake3SummerConfig) metaDigest(path string, fi os.FileInfo) (string, error) {
+	h := cfg.newHasher()
+	h.Write([]byte("b3meta1\n"))
+
+	var attrs map[string][]byte
+	for _, f := range cfg.Meta {
+		writeField(h, f)
+		switch f {
+		case MetaMode:
+			writeField(h, fi.Mode().String())
+		case MetaOwner, MetaUID:
+			uid, gid, ok := statOwner(fi)
+			if !ok {
+				return "", fmt.Errorf("b3 error: -meta %v: no owner available for '%v'", f, path)
+			}
+			if f == MetaUID {
+				writeField(h, fmt.Sprintf("%v:%v", uid, gid))
+			} else {
+				writeField(h, userName(uid)+":"+groupName(gid))
+			}
+		case MetaXattr, MetaACL:
+			if attrs == nil {
+				var err error
+				attrs, err = lxattrs(path)
+				if err != nil {
+					return "", err
+				}
+			}
+			var names []string
+			for name := range attrs {
+				if aclXattrs[name] == (f == MetaACL) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			writeField(h, fmt.Sprint(len(names)))
+			for _, name := range names {
+				writeField(h, name)
+				writeField(h, string(attrs[name]))
+			}
+		}
+	}
+	return "b3meta" + cfg.keying() + cfg.lenLabel() + cfg.encodeBytes(cfg.sumBytes(h)), nil
+}
+
+// isMetaSum reports if s is a metadata digest from b3 -meta.
+func isMetaSum(s string) bool {
+	return strings.HasPrefix(s, "b3meta")
+}
+
+// sumField is how s appears in our text output and
+// manifests: the content sum, then the metadata digest
+// with -meta, separated by a single space.
+func sumField(s *PathSum) string {
+	if s.Meta == "" {
+		return s.Sum
+	}
+	return s.Sum + " " + s.Meta
+}
+
+// splitSumField undoes sumField.
+func splitSumField(field string) (sum, meta string, ok bool) {
+	sum, meta, _ = strings.Cut(field, " ")
+	if !isSum(sum) || (meta != "" && !isMetaSum(meta)) {
+		return "", "", false
+	}
+	return sum, meta, true
+}
+
+var ownerNames struct {
+	mut    sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+// userName looks up the name of uid, remembering it,
+// since walks see the same few owners over and over.
+// Without a name, we use the number.
+func userName(uid uint32) string {
+	ownerNames.mut.Lock()
+	defer ownerNames.mut.Unlock()
+	if ownerNames.users == nil {
+		ownerNames.users = make(map[uint32]string)
+	}
+	name, ok := ownerNames.users[uid]
+	if !ok {
+		name = fmt.Sprint(uid)
+		if u, err := user.LookupId(name); err == nil {
+			name = u.Username
+		}
+		ownerNames.users[uid] = name
+	}
+	return name
+}
+
+// groupName is userName for groups.
+func groupName(gid uint32) string {
+	ownerNames.mut.Lock()
+	defer ownerNames.mut.Unlock()
+	if ownerNames.groups == nil {
+		ownerNames.groups = make(map[uint32]string)
+	}
+	name, ok := ownerNames.groups[gid]
+	if !ok {
+		name = fmt.Sprint(gid)
+		if g, err := user.LookupGroupId(name); err == nil {
+			name = g.Name
+		}
+		ownerNames.groups[gid] = name
+	}
+	return name
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package b3
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMetaDigest_SeparateFromContent(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	a := filepath.Join(root, "a")
+	panicOn(os.WriteFile(a, []byte("a"), 0644))
+
+	cfg := &Blake3SummerConfig{Quiet: true}
+	panicOn((*metaFlag)(&cfg.Meta).Set("xattr,mode"))
+	if strings.Join(cfg.Meta, ",") != "mode,xattr" {
+		t.Fatalf("-meta fields not in canonical order: %v", cfg.Meta)
+	}
+
+	plain := &Blake3SummerConfig{Quiet: true}
+	want, err := plain.Blake3OfFile(a)
+	panicOn(err)
+
+	results := make(chan *PathSum, 1)
+	panicOn(cfg.ScanOneFile(a, results))
+	s := <-results
+	if s.Sum != want || !isMetaSum(s.Meta) {
+		t.Fatalf("content sum must not change with -meta: '%v' vs '%v'; meta '%v'", s.Sum, want, s.Meta)
+	}
+
+	manifest := filepath.Join(root, "manifest.b3")
+	panicOn(cfg.WriteManifestFile(manifest, []*PathSum{s}, s.Sum))
+
+	bad, err := plain.CheckManifest(manifest)
+	if err != nil || bad != 0 {
+		t.Fatalf("expected clean verify, got bad=%v err='%v'", bad, err)
+	}
+
+	panicOn(os.Chmod(a, 0600))
+	bad, err = plain.CheckManifest(manifest)
+	if bad != 1 || err == nil || !strings.Contains(err.Error(), "0 content, 1 metadata") {
+		t.Fatalf("expected a metadata failure only, got bad=%v err='%v'", bad, err)
+	}
+	panicOn(os.Chmod(a, 0644))
+
+	err = syscall.Setxattr(a, "user.b3test", []byte("blue"), 0)
+	if err != nil {
+		t.Logf("skipping the xattr check: %v", err)
+		return
+	}
+	bad, _ = plain.CheckManifest(manifest)
+	if bad != 1 {
+		t.Fatalf("expected the new xattr to fail verify, got bad=%v", bad)
+	}
+}
@@ -0,0 +1,117 @@
+package b3
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// jsonRecord is how one PathSum appears in
+// b3 -json and -ndjson output.
+type jsonRecord struct {
+	// Record is "entry" here, to tell these apart from
+	// the final "summary" record in -ndjson output.
+	Record string `json:"record"`
+
+	Path    string `json:"path"`
+	Sum     string `json:"sum,omitempty"`
+	Meta    string `json:"meta,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mtime,omitempty"`
+	Err     string `json:"error,omitempty"`
+
+	ElapNs int64 `json:"elapsed_ns"`
+}
+
+func newJSONRecord(s *PathSum) *jsonRecord {
+	r := &jsonRecord{
+		Record: "entry",
+		Path:   s.Path,
+		Sum:    s.Sum,
+		Meta:   s.Meta,
+		Type:   s.Type,
+		Size:   s.Size,
+		ElapNs: int64(s.Elap),
+	}
+	if !s.ModTime.IsZero() {
+		r.ModTime = s.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	if s.Err != nil {
+		r.Err = s.Err.Error()
+	}
+	return r
+}
+
+// jsonSummary ends b3 -ndjson output, and is
+// the "summary" member of b3 -json output.
+type jsonSummary struct {
+	Record string `json:"record"`
+
+	// Top is DirTreeHash.TopBlake3.
+	Top  string `json:"top"`
+	Tree int    `json:"tree"`
+
+	// Context is from b3 -context.
+	Context string `json:"context,omitempty"`
+
+	Files  int   `json:"files"`
+	Dirs   int   `json:"dirs,omitempty"`
+	Errors int   `json:"errors"`
+	Bytes  int64 `json:"bytes"`
+
+	ElapNs int64 `json:"elapsed_ns"`
+}
+
+func (cfg *Blake3SummerConfig) newJSONSummary(ret *DirTreeHash, elap time.Duration) *jsonSummary {
+	sum := &jsonSummary{
+		Record:  "summary",
+		Top:     ret.TopBlake3,
+		Tree:    cfg.TreeVersion,
+		Context: cfg.Context,
+		Dirs:    len(ret.DirSums),
+		Errors:  len(ret.Errs),
+		ElapNs:  int64(elap),
+	}
+	dirs := 0
+	for _, s := range ret.PathSums {
+		if s.Type == TypeDir {
+			// from -dirs
+			dirs++
+			continue
+		}
+		sum.Files++
+		sum.Bytes += s.Size
+	}
+	if sum.Dirs == 0 {
+		sum.Dirs = dirs
+	}
+	return sum
+}
+
+// jsonDoc is the single document written by b3 -json.
+type jsonDoc struct {
+	Entries []*jsonRecord `json:"entries"`
+	Errors  []*jsonRecord `json:"errors"`
+	Summary *jsonSummary  `json:"summary"`
+}
+
+// WriteJSON writes the whole of ret as one JSON document.
+// The listing holds the entries to include, in order; it is
+// ret.PathSums, plus ret.DirSums if those were requested.
+func (cfg *Blake3SummerConfig) WriteJSON(w io.Writer, ret *DirTreeHash, listing []*PathSum, elap time.Duration) error {
+	doc := &jsonDoc{
+		Entries: []*jsonRecord{},
+		Errors:  []*jsonRecord{},
+		Summary: cfg.newJSONSummary(ret, elap),
+	}
+	for _, s := range listing {
+		doc.Entries = append(doc.Entries, newJSONRecord(s))
+	}
+	for _, s := range ret.Errs {
+		doc.Errors = append(doc.Errors, newJSONRecord(s))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,62 @@
+package b3
+
+import (
+	"io"
+	"os"
+
+	"github.com/glycerine/blake3"
+)
+
+// uncachedBuf is how much sumUncached reads at a time.
+const uncachedBuf = 1 << 20
+
+// sumUncached hashes the file at path for b3 -no-pagecache,
+// so that hashing a big tree leaves the page cache (and
+// the atimes) the way other programs had them. Unlike
+// blake3.HashFile2, it reads through one descriptor of
+// its own, opened with openNoATime, from start to end, and
+// so hashes with a single thread. The kernel is told we
+// read it in order, then once hashed, that the pages we
+// brought into the page cache can go. Pages that were
+// cached before we looked (see residentPages) are left
+// alone, as are any we cannot tell about; so are pages
+// that are dirty, or mapped by other programs.
+func (cfg *Blake3SummerConfig) sumUncached(path string) (h *blake3.Hasher, err error) {
+	fd, err := openNoATime(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	fadvise(fd, 0, 0, fadvSequential)
+	if fi, err := fd.Stat(); err == nil {
+		defer dropPagesWeRead(fd, residentPages(fd, fi.Size()))
+	}
+
+	h = cfg.newHasher()
+	// hide fd's WriteTo, so our bigger buffer gets used.
+	_, err = io.CopyBuffer(h, struct{ io.Reader }{fd}, make([]byte, uncachedBuf))
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// dropPagesWeRead tells the kernel it can drop the pages of
+// fd that were not in the page cache before we read it, per
+// cached, from residentPages. Runs of them go in one call.
+func dropPagesWeRead(fd *os.File, cached []byte) {
+	pg := int64(os.Getpagesize())
+	for i := 0; i < len(cached); {
+		if cached[i]&1 != 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < len(cached) && cached[j]&1 == 0 {
+			j++
+		}
+		fadvise(fd, int64(i)*pg, int64(j-i)*pg, fadvDontNeed)
+		i = j
+	}
+}
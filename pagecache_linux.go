@@ -0,0 +1,18 @@
+package b3
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openNoATime opens path for reading without updating its
+// atime. Only the file's owner (or root) may ask for that,
+// so on EPERM we open it the usual way.
+func openNoATime(path string) (*os.File, error) {
+	fd, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOATIME, 0)
+	if errors.Is(err, syscall.EPERM) {
+		return os.Open(path)
+	}
+	return fd, err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package b3
+
+import (
+	"os"
+)
+
+// openNoATime has no O_NOATIME to use here.
+func openNoATime(path string) (*os.File, error) {
+	return os.Open(path)
+}
@@ -0,0 +1,89 @@
+package b3
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNoPageCache_SameSums(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	small := filepath.Join(root, "small")
+	panicOn(os.WriteFile(small, []byte("small"), 0600))
+	big := filepath.Join(root, "big")
+	data := strings.Repeat("read me once ", 300000) // > 3MB, so HashFile goes parallel.
+	panicOn(os.WriteFile(big, []byte(data), 0600))
+	empty := filepath.Join(root, "empty")
+	panicOn(os.WriteFile(empty, nil, 0600))
+
+	key := []byte(strings.Repeat("k", KeyLen))
+	for _, cfg := range []*Blake3SummerConfig{{}, {Hex: true, ModTimeHash: true}, {keyMaterial: key}} {
+		cfg.initKey()
+		for _, path := range []string{small, big, empty} {
+			want, err := cfg.Blake3OfFile(path)
+			panicOn(err)
+			c2 := *cfg
+			c2.NoPageCache = true
+			got, err := c2.Blake3OfFile(path)
+			panicOn(err)
+			if got != want {
+				t.Fatalf("'%v': -no-pagecache gave '%v', want '%v'", path, got, want)
+			}
+		}
+	}
+
+	// and it reports the same errors.
+	c := &Blake3SummerConfig{NoPageCache: true}
+	if _, err := c.Blake3OfFile(filepath.Join(root, "gone")); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got '%v'", err)
+	}
+}
+
+func TestNoPageCache_LeavesCachedPages(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(root, 0700))
+	path := filepath.Join(root, "hot")
+	data := []byte(strings.Repeat("some other program reads me ", 10000))
+	fd, err := os.Create(path)
+	panicOn(err)
+	_, err = fd.Write(data)
+	panicOn(err)
+	panicOn(fd.Sync()) // dirty pages would stay anyway.
+	panicOn(fd.Close())
+
+	// read it, as another program would, to have it cached.
+	_, err = os.ReadFile(path)
+	panicOn(err)
+	resident := func() []byte {
+		fd, err := os.Open(path)
+		panicOn(err)
+		defer fd.Close()
+		return residentPages(fd, int64(len(data)))
+	}
+	before := resident()
+	if before == nil {
+		t.Skip("cannot tell what is cached here")
+	}
+
+	c := &Blake3SummerConfig{NoPageCache: true}
+	_, err = c.Blake3OfFile(path)
+	panicOn(err)
+	after := resident()
+	for i := range before {
+		if before[i]&1 != 0 && after[i]&1 == 0 {
+			t.Fatalf("page %v was cached before, and -no-pagecache dropped it", i)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package b3
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// readRchar returns the bytes this process has read so
+// far, by any read system call, from /proc/self/io. That
+// includes the parts of files still being hashed.
+func readRchar() (int64, bool) {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if v, ok := bytes.CutPrefix(line, []byte("rchar:")); ok {
+			n, err := strconv.ParseInt(string(bytes.TrimSpace(v)), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
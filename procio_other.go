@@ -0,0 +1,9 @@
+//go:build !linux
+
+package b3
+
+// readRchar is only implemented for Linux; elsewhere,
+// progress only counts the bytes of files finished.
+func readRchar() (int64, bool) {
+	return 0, false
+}
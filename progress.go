@@ -0,0 +1,332 @@
+package b3
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often b3 -progress reports: the status line on a
+// terminal is redrawn often, while the #b3-progress lines
+// written anywhere else are kept few.
+const (
+	progressTTYEvery  = 250 * time.Millisecond
+	progressLineEvery = 10 * time.Second
+)
+
+// progress counts what a scan has done, for b3 -progress
+// and for the state dump on SIGUSR1 (see dumpSignals).
+// It is safe for concurrent use, and a nil *progress
+// counts nothing.
+type progress struct {
+	t0 time.Time
+
+	// rchar0 is what /proc/self/io said we had read when
+	// we started, so we can count the bytes read by files
+	// still being hashed, where the platform allows.
+	rchar0    int64
+	haveRchar bool
+
+	found      atomic.Int64
+	foundBytes atomic.Int64
+	walked     atomic.Bool
+
+	done      atomic.Int64
+	doneBytes atomic.Int64
+	failed    atomic.Int64
+
+	// bytes of standard input hashed so far.
+	streamed atomic.Int64
+
+	mut  sync.Mutex
+	busy map[string]time.Time // paths being hashed, and since when
+
+	// term guards stderr while -progress keeps a status
+	// line on a terminal; statusShown says it is there
+	// now, to be cleared before anything else is printed.
+	term        sync.Mutex
+	statusShown bool
+}
+
+func newProgress() *progress {
+	p := &progress{
+		t0:   time.Now(),
+		busy: make(map[string]time.Time),
+	}
+	p.rchar0, p.haveRchar = readRchar()
+	return p
+}
+
+// foundFile counts a file that is to be hashed, of size
+// bytes, if known (else 0).
+func (p *progress) foundFile(size int64) {
+	if p == nil {
+		return
+	}
+	p.found.Add(1)
+	p.foundBytes.Add(size)
+}
+
+// walkDone says every file to be hashed has been found.
+func (p *progress) walkDone() {
+	if p == nil {
+		return
+	}
+	p.walked.Store(true)
+}
+
+func (p *progress) begin(path string) {
+	if p == nil {
+		return
+	}
+	p.mut.Lock()
+	p.busy[path] = time.Now()
+	p.mut.Unlock()
+}
+
+func (p *progress) end(s *PathSum) {
+	if p == nil {
+		return
+	}
+	p.mut.Lock()
+	delete(p.busy, s.Path)
+	p.mut.Unlock()
+
+	p.done.Add(1)
+	p.doneBytes.Add(s.Size)
+	if s.Err != nil {
+		p.failed.Add(1)
+	}
+}
+
+// progressReader counts the bytes read from standard input.
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (n int, err error) {
+	n, err = pr.r.Read(b)
+	pr.p.streamed.Add(int64(n))
+	return
+}
+
+// progressState is a snapshot of a progress.
+type progressState struct {
+	Elapsed    time.Duration
+	Files      int64
+	Found      int64
+	Bytes      int64
+	FoundBytes int64
+	Errors     int64
+	Walked     bool
+
+	// Rate is in bytes per second. ETA is
+	// negative if we cannot tell yet.
+	Rate float64
+	ETA  time.Duration
+}
+
+func (p *progress) state() (st progressState) {
+	st = progressState{
+		Elapsed:    time.Since(p.t0),
+		Files:      p.done.Load(),
+		Found:      p.found.Load(),
+		FoundBytes: p.foundBytes.Load(),
+		Errors:     p.failed.Load(),
+		Walked:     p.walked.Load(),
+		ETA:        -1,
+	}
+	// files finish whole, so with /proc/self/io we also
+	// count what was read of the files still in flight.
+	st.Bytes = p.doneBytes.Load() + p.streamed.Load()
+	if p.haveRchar {
+		if rchar, ok := readRchar(); ok && rchar-p.rchar0 > st.Bytes {
+			st.Bytes = rchar - p.rchar0
+			if st.FoundBytes > 0 && st.Bytes > st.FoundBytes {
+				st.Bytes = st.FoundBytes
+			}
+		}
+	}
+	if secs := st.Elapsed.Seconds(); secs > 0 {
+		st.Rate = float64(st.Bytes) / secs
+	}
+	switch {
+	case !st.Walked:
+	case st.FoundBytes > 0 && st.Rate > 0:
+		st.ETA = time.Duration(float64(st.FoundBytes-st.Bytes) / st.Rate * float64(time.Second))
+	case st.Files > 0:
+		st.ETA = time.Duration(float64(st.Found-st.Files) / float64(st.Files) * float64(st.Elapsed))
+	}
+	return
+}
+
+// statusLine is the one line b3 -progress keeps
+// redrawing on a terminal.
+func (st progressState) statusLine() string {
+	found := "?"
+	if st.Walked {
+		found = fmt.Sprint(st.Found)
+	}
+	line := fmt.Sprintf("b3: %v/%v files, %v", st.Files, found, humanBytes(st.Bytes))
+	if st.Walked && st.FoundBytes > 0 {
+		line += "/" + humanBytes(st.FoundBytes)
+	}
+	line += fmt.Sprintf(", %v/sec", humanBytes(int64(st.Rate)))
+	if st.ETA >= 0 {
+		line += fmt.Sprintf(", ETA %v", st.ETA.Round(time.Second))
+	}
+	if st.Errors > 0 {
+		line += fmt.Sprintf(", %v errors", st.Errors)
+	}
+	return line
+}
+
+// record is the machine readable form of st, written
+// by b3 -progress when stderr is not a terminal. Like
+// the manifest header, it is space separated key=value
+// pairs, with times in seconds. eta is -1 if unknown.
+func (st progressState) record() string {
+	eta := -1.0
+	if st.ETA >= 0 {
+		eta = st.ETA.Seconds()
+	}
+	return fmt.Sprintf("#b3-progress elapsed=%.1f files=%v files_found=%v bytes=%v bytes_found=%v bytes_per_sec=%.0f eta=%.1f errors=%v walk_done=%v",
+		st.Elapsed.Seconds(), st.Files, st.Found, st.Bytes, st.FoundBytes, st.Rate, eta, st.Errors, st.Walked)
+}
+
+// dump writes the current state, and the files being
+// hashed right now, longest running first.
+func (p *progress) dump(w io.Writer) {
+	st := p.state()
+	p.mut.Lock()
+	paths := make([]string, 0, len(p.busy))
+	for path := range p.busy {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return p.busy[paths[i]].Before(p.busy[paths[j]])
+	})
+	since := make([]time.Duration, len(paths))
+	for i, path := range paths {
+		since[i] = time.Since(p.busy[path])
+	}
+	p.mut.Unlock()
+
+	fmt.Fprintln(w, st.record())
+	for i, path := range paths {
+		fmt.Fprintf(w, "#b3-progress hashing=%q for=%.1f\n", path, since[i].Seconds())
+	}
+}
+
+// startProgress starts counting the scan in cfg.progress,
+// dumping its state on stderr whenever we get one of the
+// dumpSignals, and with cfg.Progress, reporting it on stderr
+// as we go. Call stop when the scan is done. It leaves
+// cfg.progress in place, still counting but no longer
+// reporting, since with -failfast the scan returns while
+// workers may still be finishing their files.
+func (cfg *Blake3SummerConfig) startProgress() (stop func()) {
+	p := newProgress()
+	cfg.progress = p
+
+	sig := make(chan os.Signal, 1)
+	if len(dumpSignals) > 0 {
+		signal.Notify(sig, dumpSignals...)
+	}
+	tty := isTerminal(os.Stderr)
+	every := progressLineEvery
+	if tty {
+		every = progressTTYEvery
+	}
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if cfg.Progress {
+		ticker = time.NewTicker(every)
+		tick = ticker.C
+	}
+
+	halt := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-sig:
+				p.above(func() { p.dump(os.Stderr) })
+			case <-tick:
+				if tty {
+					line := p.state().statusLine()
+					p.term.Lock()
+					fmt.Fprintf(os.Stderr, "\r%v\x1b[K", line)
+					p.statusShown = true
+					p.term.Unlock()
+				} else {
+					fmt.Fprintln(os.Stderr, p.state().record())
+				}
+			case <-halt:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sig)
+		if ticker != nil {
+			ticker.Stop()
+		}
+		close(halt)
+		<-finished
+		if cfg.Progress {
+			if tty {
+				p.above(func() {})
+			} else {
+				// so readers always see the final counts.
+				fmt.Fprintln(os.Stderr, p.state().record())
+			}
+		}
+	}
+}
+
+// above calls print with the -progress status line, if
+// shown, cleared off the terminal first, so that what print
+// writes does not run into it. The next tick redraws it.
+func (p *progress) above(print func()) {
+	if p == nil {
+		print()
+		return
+	}
+	p.term.Lock()
+	defer p.term.Unlock()
+	if p.statusShown {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		p.statusShown = false
+	}
+	print()
+}
+
+// isTerminal reports if f looks like a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// humanBytes formats n like "1.5 GB", in powers of 1024.
+func humanBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%v B", n)
+	}
+	v := float64(n)
+	i := -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", v, units[i])
+}
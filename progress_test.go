@@ -0,0 +1,43 @@
+package b3
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProgress_CountsAndDump(t *testing.T) {
+
+	p := newProgress()
+	p.foundFile(100)
+	p.foundFile(300)
+	p.walkDone()
+
+	p.begin("a")
+	p.begin("b")
+	p.end(&PathSum{Path: "a", Size: 100})
+
+	st := p.state()
+	if st.Files != 1 || st.Found != 2 || st.FoundBytes != 400 || !st.Walked {
+		t.Fatalf("unexpected state %#v", st)
+	}
+	if st.Bytes < 100 || st.Bytes > 400 {
+		t.Fatalf("bytes done should be from 100 to 400, not %v", st.Bytes)
+	}
+
+	var buf bytes.Buffer
+	p.dump(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "#b3-progress elapsed=") ||
+		!strings.Contains(lines[0], " files=1 files_found=2 ") ||
+		!strings.HasPrefix(lines[1], `#b3-progress hashing="b" for=`) {
+		t.Fatalf("unexpected dump:\n%v", buf.String())
+	}
+
+	// a nil progress counts nothing, and does not crash.
+	var none *progress
+	none.foundFile(1)
+	none.begin("a")
+	none.end(&PathSum{Path: "a"})
+	none.walkDone()
+}
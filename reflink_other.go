@@ -0,0 +1,16 @@
+//go:build !linux
+
+package b3
+
+import (
+	"fmt"
+	"os"
+)
+
+// reflinkSupported says if reflink works on this platform.
+const reflinkSupported = false
+
+// reflink is only implemented for Linux so far.
+func reflink(dst, src *os.File) error {
+	return fmt.Errorf("b3 error: reflinks are not supported on this platform")
+}
@@ -0,0 +1,73 @@
+package b3
+
+import (
+	"sync"
+)
+
+// reorderWindow is how many paths may be found but not yet
+// passed on in order, at once. It bounds how many results a
+// reorderBuffer holds back behind a slow file, and so how far
+// the walk may run ahead of the hashing.
+const reorderWindow = 1 << 16
+
+// reorderBuffer passes on the results of a scan in the order
+// their paths were found, each as soon as every path found
+// before it is done. When the walk finds them in sorted order
+// (see walkInOrder), that is sorted order, so the listing can
+// be printed as we go rather than all at the end.
+type reorderBuffer struct {
+	// a token for each path found and not yet passed on.
+	slots chan struct{}
+
+	mut   sync.Mutex
+	found []string // in order, not yet passed on
+	done  map[string]*PathSum
+
+	// out is given each result in order; if nil, results
+	// are just let go of.
+	out func(s *PathSum)
+}
+
+func newReorderBuffer(out func(s *PathSum)) *reorderBuffer {
+	return &reorderBuffer{
+		slots: make(chan struct{}, reorderWindow),
+		done:  make(map[string]*PathSum),
+		out:   out,
+	}
+}
+
+// add notes that path was found, to be hashed, first
+// waiting while reorderWindow paths are held already.
+func (r *reorderBuffer) add(path string) {
+	r.slots <- struct{}{}
+	r.mut.Lock()
+	r.found = append(r.found, path)
+	r.mut.Unlock()
+}
+
+// finished takes the result for a path given to add, then
+// passes on every result that is next in order. Call it
+// from only one goroutine at a time.
+func (r *reorderBuffer) finished(s *PathSum) {
+	r.mut.Lock()
+	r.done[s.Path] = s
+	var ready []*PathSum
+	for len(r.found) > 0 {
+		next, ok := r.done[r.found[0]]
+		if !ok {
+			break
+		}
+		delete(r.done, r.found[0])
+		r.found[0] = ""
+		r.found = r.found[1:]
+		ready = append(ready, next)
+	}
+	r.mut.Unlock()
+
+	for _, s := range ready {
+		if r.out != nil {
+			r.out(s)
+		}
+		<-r.slots
+	}
+}
@@ -0,0 +1,90 @@
+package b3
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestReorderBuffer_InFoundOrder(t *testing.T) {
+
+	var got []string
+	r := newReorderBuffer(func(s *PathSum) {
+		got = append(got, s.Path)
+	})
+	for _, path := range []string{"a", "b", "c", "d"} {
+		r.add(path)
+	}
+	r.finished(&PathSum{Path: "c"})
+	r.finished(&PathSum{Path: "b"})
+	if len(got) != 0 {
+		t.Fatalf("passed on %v before a was done", got)
+	}
+	r.finished(&PathSum{Path: "a"})
+	if len(got) != 3 || got[2] != "c" {
+		t.Fatalf("want a, b, c out, got %v", got)
+	}
+	r.finished(&PathSum{Path: "d"})
+	if len(got) != 4 || len(r.slots) != 0 || len(r.done) != 0 {
+		t.Fatalf("not all passed on: %v", got)
+	}
+}
+
+func TestSortedWalk_FindsInSortedOrder(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	// names that sort differently with and without
+	// the "/" after a directory's name.
+	for _, dir := range []string{"a/b", "a-b", "a.d", "z/y"} {
+		panicOn(os.MkdirAll(filepath.Join(root, dir), 0700))
+	}
+	for _, f := range []string{"a.txt", "a/x", "a/b/c", "a/b.txt", "a/b0", "a-b/q", "a.d/r", "a0", "z/y/w", "z/y.txt", "B"} {
+		panicOn(os.WriteFile(filepath.Join(root, f), []byte(f), 0600))
+	}
+
+	cfg := &Blake3SummerConfig{}
+	fs := flag.NewFlagSet("b3", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	targets, err := filepath.Glob(root + "/*") // as the shell would.
+	panicOn(err)
+	panicOn(fs.Parse(append([]string{"-r"}, targets...)))
+	panicOn(cfg.FinishConfig(fs))
+	if !cfg.walkInOrder() || !cfg.streamListing() {
+		t.Fatalf("one glob should walk in order")
+	}
+
+	cfg.sortedWalk = true
+	// each target lists its directory again; pathFeed
+	// drops the repeats, and so do we.
+	var found []string
+	seen := make(map[string]bool)
+	panicOn(cfg.walkTargets(func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			found = append(found, path)
+		}
+	}))
+	if len(found) != 11 || !sort.StringsAreSorted(found) {
+		t.Fatalf("not found in sorted order: %v", found)
+	}
+
+	// one target inside another cannot be.
+	cfg.Globs = []string{root + "/*", root + "/a/*"}
+	if cfg.walkInOrder() {
+		t.Fatalf("nested targets should not walk in order")
+	}
+	cfg.Globs = []string{"*", "../x/*", root + "-b/*"}
+	if cfg.walkInOrder() {
+		t.Fatalf("a target in . should not walk in order with .")
+	}
+	cfg.Globs = []string{"x/*", "../x/*", "x-b/*", "/x/*"}
+	if !cfg.walkInOrder() {
+		t.Fatalf("side by side targets should walk in order")
+	}
+}
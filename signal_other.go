@@ -0,0 +1,11 @@
+//go:build !unix
+
+package b3
+
+import (
+	"os"
+)
+
+// dumpSignals make a running scan print its progress;
+// there is no SIGUSR1 here.
+var dumpSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package b3
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals make a running scan print its progress; see startProgress.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
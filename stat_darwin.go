@@ -0,0 +1,26 @@
+package b3
+
+import (
+	"os"
+	"syscall"
+)
+
+// statIdent returns the device, inode, and status change
+// time (ctime) of fi, which must come from os.Stat or os.Lstat.
+func statIdent(fi os.FileInfo) (dev, ino uint64, ctimeNs int64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return uint64(st.Dev), uint64(st.Ino), st.Ctimespec.Nano(), true
+}
+
+// statOwner returns the numeric owner and group of fi,
+// which must come from os.Stat or os.Lstat.
+func statOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return st.Uid, st.Gid, true
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package b3
+
+import (
+	"os"
+)
+
+// statIdent is not available here, so the hash cache
+// never finds a match and every file is rehashed.
+func statIdent(fi os.FileInfo) (dev, ino uint64, ctimeNs int64, ok bool) {
+	return
+}
+
+// statOwner is not available here either.
+func statOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	return
+}
@@ -0,0 +1,267 @@
+package b3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/glycerine/blake3"
+)
+
+// Formats for the hash of hashes in DirTreeHash.TopBlake3,
+// selected by Blake3SummerConfig.TreeVersion (b3 -tree).
+const (
+	// TreeFlat is the original hash of hashes: just the
+	// file sums, concatenated in sorted path order. Since
+	// paths are not included, renaming a file, or swapping
+	// the contents of two files, can leave it unchanged.
+	// It is labeled like any other sum, "blake3.33B-".
+	TreeFlat = 0
+
+	// TreePaths commits to the path of each file relative
+	// to the scan root, its type, and its sum. It is
+	// labeled "b3tree1.33B-" (or "b3tree1.hex-" with -hex)
+	// so that it can never be confused with a TreeFlat sum.
+	TreePaths = 1
+
+	// TreeMerkle gives every directory its own hash, made
+	// from the names, types, and sums of its children, with
+	// subdirectories contributing their own directory hash.
+	// The top hash is that of the root directory. Two trees
+	// can then be compared from the top down, following only
+	// the directories whose hashes differ. Directory hashes
+	// are labeled "b3tree2.33B-" (or "b3tree2.hex-").
+	TreeMerkle = 2
+)
+
+// PathSum.Type values.
+const (
+	TypeFile    = "file"
+	TypeSymlink = "symlink"
+	TypeDir     = "dir"
+)
+
+func fileType(fi os.FileInfo) string {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return TypeSymlink
+	}
+	return TypeFile
+}
+
+// typeByte is how a PathSum.Type is committed to a tree hash.
+func typeByte(typ string) byte {
+	switch typ {
+	case TypeSymlink:
+		return 'l'
+	case TypeDir:
+		return 'd'
+	}
+	return 'f'
+}
+
+// TreeHash computes the hash of hashes over sums, which must
+// already be sorted by Path, in the format chosen by
+// cfg.TreeVersion. For TreePaths, root is stripped from the
+// front of each path first; see treeRoot.
+func (cfg *Blake3SummerConfig) TreeHash(sums []*PathSum, root string) string {
+	hoh := cfg.newHasher()
+
+	switch cfg.TreeVersion {
+	case TreePaths:
+		// Domain separate from every other use of blake3,
+		// then length-prefix each variable length field so
+		// that no two different trees give the same stream.
+		hoh.Write([]byte("b3tree1\n"))
+		for _, s := range sums {
+			writeField(hoh, strings.TrimPrefix(s.Path, root))
+			hoh.Write([]byte{typeByte(s.Type)})
+			writeField(hoh, s.Sum)
+		}
+		return cfg.encodeTree(TreePaths, hoh)
+	case TreeMerkle:
+		top, _ := cfg.MerkleTree(sums, root)
+		return top
+	}
+
+	for _, s := range sums {
+		hoh.Write([]byte(s.Sum))
+	}
+	return cfg.encodeSum(hoh)
+}
+
+// MerkleTree computes the TreeMerkle hash of every directory
+// implied by the paths in sums, with root stripped from the
+// front of each path. The root directory's hash is returned
+// as top. The directory hashes are returned in dirSums, sorted
+// by Path, each with a trailing "/" on its Path and Type TypeDir.
+// The root directory itself is last, with Path root (or "./").
+func (cfg *Blake3SummerConfig) MerkleTree(sums []*PathSum, root string) (top string, dirSums []*PathSum) {
+
+	// children of each directory, by relative path, with ""
+	// for the root. Directories only exist here because
+	// some file below them does, or with -dirs, because
+	// they were listed.
+	kids := make(map[string][]string)
+	files := make(map[string]*PathSum)
+	seen := map[string]bool{"": true}
+
+	for _, s := range sums {
+		rel := strings.TrimPrefix(s.Path, root)
+		if s.Type == TypeDir {
+			// a directory entry from -dirs, which
+			// makes empty directories count too.
+			rel = strings.TrimSuffix(rel, "/")
+			for dir := rel; dir != "" && !seen[dir]; {
+				seen[dir] = true
+				parent, name := splitRel(dir)
+				kids[parent] = append(kids[parent], name)
+				dir = parent
+			}
+			continue
+		}
+		files[rel] = s
+		dir, name := splitRel(rel)
+		kids[dir] = append(kids[dir], name)
+		for !seen[dir] {
+			seen[dir] = true
+			parent, name := splitRel(dir)
+			kids[parent] = append(kids[parent], name)
+			dir = parent
+		}
+	}
+
+	var hashDir func(dir string) string
+	hashDir = func(dir string) string {
+		names := kids[dir]
+		sort.Strings(names)
+
+		h := cfg.newHasher()
+		h.Write([]byte("b3tree2\n"))
+		for _, name := range names {
+			rel := joinRel(dir, name)
+			writeField(h, name)
+			if s, ok := files[rel]; ok {
+				h.Write([]byte{typeByte(s.Type)})
+				writeField(h, s.Sum)
+			} else {
+				h.Write([]byte{typeByte(TypeDir)})
+				writeField(h, hashDir(rel))
+			}
+		}
+		sum := cfg.encodeTree(TreeMerkle, h)
+
+		path := root + dir + "/"
+		if dir == "" {
+			path = root
+			if path == "" {
+				path = "./"
+			}
+		}
+		dirSums = append(dirSums, &PathSum{Path: path, Sum: sum, Type: TypeDir})
+		return sum
+	}
+	top = hashDir("")
+
+	// root is last, the rest in path order.
+	sort.Sort(pathsumSlice(dirSums[:len(dirSums)-1]))
+	return
+}
+
+// sumDirEntries gives each directory entry in sums, from
+// b3 -dirs, its Sum: a hash of the names and types of the
+// entries listed directly under it. An empty directory, or
+// one that gained, lost, or renamed an entry, is then seen to
+// change, even with TreeFlat. Sums are labeled "b3dir", then
+// cfg.keying() and the lenLabel, like "b3dir.33B-".
+func (cfg *Blake3SummerConfig) sumDirEntries(sums []*PathSum) {
+
+	// directory path, with its trailing "/" -> entries under it
+	kids := make(map[string][]*PathSum)
+	for _, s := range sums {
+		p := strings.TrimSuffix(s.Path, "/")
+		if i := strings.LastIndex(p, "/"); i >= 0 {
+			kids[p[:i+1]] = append(kids[p[:i+1]], s)
+		}
+	}
+	for _, s := range sums {
+		if s.Type != TypeDir {
+			continue
+		}
+		under := kids[s.Path]
+		names := make([]string, len(under))
+		types := make(map[string]byte)
+		for i, k := range under {
+			names[i] = strings.TrimSuffix(strings.TrimPrefix(k.Path, s.Path), "/")
+			types[names[i]] = typeByte(k.Type)
+		}
+		sort.Strings(names)
+
+		h := cfg.newHasher()
+		h.Write([]byte("b3dir1\n"))
+		for _, name := range names {
+			writeField(h, name)
+			h.Write([]byte{types[name]})
+		}
+		s.Sum = "b3dir" + cfg.keying() + cfg.lenLabel() + cfg.encodeBytes(cfg.sumBytes(h))
+	}
+}
+
+// splitRel splits a relative path into its parent directory
+// and final name. A leading "/" stays with the name, so that
+// absolute paths cannot collide with relative ones.
+func splitRel(rel string) (dir, name string) {
+	i := strings.LastIndex(rel, "/")
+	if i <= 0 {
+		return "", rel
+	}
+	return rel[:i], rel[i+1:]
+}
+
+func joinRel(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// writeField writes the 8-byte big-endian length of field, then field.
+func writeField(w io.Writer, field string) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(field)))
+	w.Write(n[:])
+	io.WriteString(w, field)
+}
+
+// encodeTree labels a tree hash with its format version,
+// then cfg.keying() for keyed and derived key hashes, then
+// the lenLabel, like "b3tree1.33B-".
+func (cfg *Blake3SummerConfig) encodeTree(version int, h *blake3.Hasher) string {
+	return fmt.Sprintf("b3tree%v%v%v", version, cfg.keying(), cfg.lenLabel()) +
+		cfg.encodeBytes(cfg.sumBytes(h))
+}
+
+// treeRoot returns the prefix to strip from each path
+// before it goes into a TreePaths hash. When all targets
+// are in the same parent directory, paths are made relative
+// to it, so that "b3 -r /src/data" and "b3 -r /mnt/data"
+// give the same tree hash for identical trees.
+func (cfg *Blake3SummerConfig) treeRoot() string {
+	if cfg.PathListStdin || len(cfg.Globs) == 0 {
+		return ""
+	}
+	d := filepath.Dir(cfg.Globs[0])
+	for _, g := range cfg.Globs[1:] {
+		if filepath.Dir(g) != d {
+			return ""
+		}
+	}
+	if d == "." {
+		return ""
+	}
+	// the same prefix walkTargets puts on the paths it finds.
+	return d + "/"
+}
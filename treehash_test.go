@@ -0,0 +1,175 @@
+package b3
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTreeHash_PathsAreCommitted(t *testing.T) {
+
+	a := &PathSum{Path: "d/a", Sum: "blake3.33B-AAAA", Type: TypeFile}
+	b := &PathSum{Path: "d/b", Sum: "blake3.33B-BBBB", Type: TypeFile}
+
+	// the same sums, with the contents of a and b swapped.
+	swapA := &PathSum{Path: "d/a", Sum: b.Sum, Type: TypeFile}
+	swapB := &PathSum{Path: "d/b", Sum: a.Sum, Type: TypeFile}
+
+	// a renamed to c.
+	renamed := &PathSum{Path: "d/c", Sum: a.Sum, Type: TypeFile}
+
+	orig := []*PathSum{a, b}
+	swapped := []*PathSum{swapB, swapA} // sorted by sum, as before
+	moved := []*PathSum{b, renamed}
+
+	flat := &Blake3SummerConfig{TreeVersion: TreeFlat}
+	if flat.TreeHash(orig, "") != flat.TreeHash(swapped, "") {
+		t.Fatalf("TreeFlat should not see the swap; that is why TreePaths exists")
+	}
+
+	v1 := &Blake3SummerConfig{TreeVersion: TreePaths}
+	top := v1.TreeHash(orig, "d/")
+	if top == v1.TreeHash(swapped, "d/") {
+		t.Fatalf("TreePaths did not notice swapped contents")
+	}
+	if top == v1.TreeHash(moved, "d/") {
+		t.Fatalf("TreePaths did not notice a rename")
+	}
+
+	// the same tree under a different root hashes the same.
+	other := []*PathSum{
+		{Path: "mirror/a", Sum: a.Sum, Type: TypeFile},
+		{Path: "mirror/b", Sum: b.Sum, Type: TypeFile},
+	}
+	if top != v1.TreeHash(other, "mirror/") {
+		t.Fatalf("TreePaths should be relative to the root")
+	}
+
+	symlinked := []*PathSum{{Path: "d/a", Sum: a.Sum, Type: TypeSymlink}, b}
+	if top == v1.TreeHash(symlinked, "d/") {
+		t.Fatalf("TreePaths did not notice a change of file type")
+	}
+
+	if top[:len("b3tree1.33B-")] != "b3tree1.33B-" {
+		t.Fatalf("unexpected label on '%v'", top)
+	}
+}
+
+func TestMerkleTree_LocatesTheChange(t *testing.T) {
+
+	sums := []*PathSum{
+		{Path: "r/a/x", Sum: "blake3.33B-X", Type: TypeFile},
+		{Path: "r/a/y", Sum: "blake3.33B-Y", Type: TypeFile},
+		{Path: "r/b/c/z", Sum: "blake3.33B-Z", Type: TypeFile},
+		{Path: "r/top", Sum: "blake3.33B-T", Type: TypeFile},
+	}
+	changed := []*PathSum{sums[0], sums[1],
+		{Path: "r/b/c/z", Sum: "blake3.33B-CHANGED", Type: TypeFile},
+		sums[3],
+	}
+
+	cfg := &Blake3SummerConfig{TreeVersion: TreeMerkle}
+	top1, dirs1 := cfg.MerkleTree(sums, "r/")
+	top2, dirs2 := cfg.MerkleTree(changed, "r/")
+
+	if top1 == top2 {
+		t.Fatalf("root hash did not change")
+	}
+	if top1 != cfg.TreeHash(sums, "r/") {
+		t.Fatalf("TreeHash and MerkleTree disagree on the root")
+	}
+
+	// root is last; the rest are sorted: r/a/, r/b/, r/b/c/
+	want := []string{"r/a/", "r/b/", "r/b/c/", "r/"}
+	if len(dirs1) != len(want) {
+		t.Fatalf("want %v dirs, got %v", len(want), len(dirs1))
+	}
+	differ := make(map[string]bool)
+	for i, d := range dirs1 {
+		if d.Path != want[i] {
+			t.Fatalf("dir %v: want '%v', got '%v'", i, want[i], d.Path)
+		}
+		if d.Type != TypeDir {
+			t.Fatalf("dir %v has Type '%v'", d.Path, d.Type)
+		}
+		if d.Sum != dirs2[i].Sum {
+			differ[d.Path] = true
+		}
+	}
+	if len(differ) != 3 || differ["r/a/"] {
+		t.Fatalf("only r/, r/b/, and r/b/c/ should differ; got %v", differ)
+	}
+}
+
+func TestDirEntries_EmptyDirsCount(t *testing.T) {
+
+	// the walk finds d/ and d/a; then the same with an
+	// empty directory d/e/ beside d/a.
+	tree := func(empty bool) []*PathSum {
+		sums := []*PathSum{
+			{Path: "d/", Type: TypeDir},
+			{Path: "d/a", Sum: "blake3.33B-AAAA", Type: TypeFile},
+		}
+		if empty {
+			sums = append(sums, &PathSum{Path: "d/e/", Type: TypeDir})
+		}
+		return sums
+	}
+	for _, version := range []int{TreeFlat, TreePaths, TreeMerkle} {
+		cfg := &Blake3SummerConfig{TreeVersion: version, Dirs: true}
+		without, with := tree(false), tree(true)
+		cfg.sumDirEntries(without)
+		cfg.sumDirEntries(with)
+		if !isDirSum(with[0].Sum) || !isDirSum(with[2].Sum) {
+			t.Fatalf("directory entries were not summed: %#v", with)
+		}
+		if without[0].Sum == with[0].Sum {
+			t.Fatalf("d/ should change when d/e/ is made")
+		}
+		if cfg.TreeHash(without, "") == cfg.TreeHash(with, "") {
+			t.Fatalf("tree %v did not notice the empty directory", version)
+		}
+	}
+
+	// in a Merkle tree, the empty directory gets a hash of its own.
+	cfg := &Blake3SummerConfig{TreeVersion: TreeMerkle, Dirs: true}
+	_, dirSums := cfg.MerkleTree(tree(true), "")
+	if len(dirSums) != 3 || dirSums[1].Path != "d/e/" {
+		t.Fatalf("unexpected dirSums %#v", dirSums)
+	}
+}
+
+func TestDirEntries_OnlyUnderTargets(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	// walkTargets walks every directory beside the target,
+	// so ord/ is read, but none of it should be listed.
+	for _, dir := range []string{"data/sub", "data/empty", "ord/a"} {
+		panicOn(os.MkdirAll(filepath.Join(root, dir), 0700))
+	}
+	panicOn(os.WriteFile(filepath.Join(root, "data/sub/f"), []byte("f"), 0600))
+	panicOn(os.WriteFile(filepath.Join(root, "ord/a/g"), []byte("g"), 0600))
+
+	cfg := &Blake3SummerConfig{}
+	fs := flag.NewFlagSet("b3", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	panicOn(fs.Parse([]string{"-r", "-dirs", "-xglob", "empty", filepath.Join(root, "data")}))
+	panicOn(cfg.FinishConfig(fs))
+
+	var found []string
+	panicOn(cfg.walkTargets(func(path string) {
+		found = append(found, path)
+	}))
+	sort.Strings(found)
+	want := []string{root + "/data/", root + "/data/sub/", root + "/data/sub/f"}
+	if strings.Join(found, " ") != strings.Join(want, " ") {
+		t.Fatalf("want %v, got %v", want, found)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"iter"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 // DirIter efficiently scans a filesystems directory
@@ -34,6 +35,33 @@ type DirIter struct {
 	// as one depth level, even if it involved
 	// chasing multiple symlinks to their target.
 	MaxDepth int
+
+	// Ignore, if set, makes FilesOnly leave out the
+	// paths that its ignore files name, without
+	// descending into ignored directories. With
+	// OnlyIgnored, FilesOnly returns just the files
+	// that would have been left out, instead.
+	Ignore      *Ignorer
+	OnlyIgnored bool
+
+	// SkipDir, if set, is called with each directory
+	// below the root before FilesOnly descends into it.
+	// Returning true skips the directory and everything
+	// under it, without reading any of it.
+	SkipDir func(dir string) bool
+
+	// VisitDir, if set, is called with each directory
+	// that FilesOnly reads, root included, before any of
+	// the files in it are returned. Directories that the
+	// ignore files leave out (or, with OnlyIgnored, keep)
+	// are read for what is under them, but not visited.
+	VisitDir func(dir string)
+
+	// Sorted makes FilesOnly read each directory whole,
+	// rather than BatchSize entries at a time, and go
+	// through it in sorted order, so that the paths come
+	// out sorted too. See sortDirEntries.
+	Sorted bool
 }
 
 // NewDirIter creates a new DirIter.
@@ -100,13 +128,46 @@ func (di *DirIter) DirsDepthFirstLeafOnly(root string) iter.Seq2[string, bool] {
 // returned paths if need be when using FollowSymlinks true.
 // Resolving a symlink through multiple other symlinks
 // will only count as one depth level for MaxDepth stopping.
+// See di.Ignore for ignore files; root itself is never ignored.
 func (di *DirIter) FilesOnly(root string) iter.Seq2[string, bool] {
 	return func(yield func(string, bool) bool) {
 
-		// Helper function for recursive traversal
-		var visit func(path string, depth int) bool
+		// yieldFile gives path to the caller, unless
+		// di.Ignore says otherwise. under means path is
+		// in an ignored directory.
+		yieldFile := func(path string, under bool) bool {
+			if di.Ignore != nil && !under {
+				under = di.Ignore.Ignored(path, false)
+			}
+			if di.Ignore != nil && under != di.OnlyIgnored {
+				return true
+			}
+			return yield(path, true)
+		}
+
+		// Helper function for recursive traversal. under
+		// means path is (in) an ignored directory.
+		var visit func(path string, depth int, under bool) bool
+
+		// visitDir visits a sub-directory, unless di.SkipDir
+		// or di.Ignore says to skip it.
+		visitDir := func(path string, depth int, under bool) bool {
+			if di.SkipDir != nil && di.SkipDir(path) {
+				return true
+			}
+			if di.Ignore != nil && !under {
+				if di.Ignore.SkipGit && filepath.Base(path) == ".git" {
+					return true
+				}
+				under = di.Ignore.Ignored(path, true)
+				if under && !di.OnlyIgnored {
+					return true
+				}
+			}
+			return visit(path, depth, under)
+		}
 
-		visit = func(path string, depth int) bool {
+		visit = func(path string, depth int, under bool) bool {
 			//vv("top of visit, path = '%v'; depth = %v", path, depth)
 			if di.MaxDepth > 0 && depth >= di.MaxDepth {
 				return true // true lets cousins also get to max depth.
@@ -118,8 +179,19 @@ func (di *DirIter) FilesOnly(root string) iter.Seq2[string, bool] {
 			}
 			defer dir.Close()
 
+			if di.VisitDir != nil && (di.Ignore == nil || under == di.OnlyIgnored) {
+				di.VisitDir(path)
+			}
+
+			batch := di.BatchSize
+			if di.Sorted {
+				batch = -1
+			}
 			for {
-				entries, err := dir.ReadDir(di.BatchSize)
+				entries, err := dir.ReadDir(batch)
+				if di.Sorted {
+					sortDirEntries(entries)
+				}
 				// Process entries in directory order
 				for _, entry := range entries {
 					//vv("entry = '%#v'; entry.Type()&fs.ModeSymlink = %v", entry, entry.Type()&fs.ModeSymlink)
@@ -136,7 +208,7 @@ func (di *DirIter) FilesOnly(root string) iter.Seq2[string, bool] {
 							//}
 
 							//vv("unfollowed symlink : '%v'", entry.Name())
-							if !yield(resolveMe, true) {
+							if !yieldFile(resolveMe, under) {
 								return false
 							}
 							continue
@@ -160,11 +232,11 @@ func (di *DirIter) FilesOnly(root string) iter.Seq2[string, bool] {
 
 						if fi.IsDir() {
 							// Recurse immediately when we find a directory
-							if !visit(target, depth+1) {
+							if !visitDir(target, depth+1, under) {
 								return false
 							}
 						} else {
-							if !yield(target, true) {
+							if !yieldFile(target, under) {
 								return false
 							}
 						}
@@ -173,17 +245,17 @@ func (di *DirIter) FilesOnly(root string) iter.Seq2[string, bool] {
 
 					if entry.IsDir() {
 						// Recurse immediately when we find a directory
-						if !visit(filepath.Join(path, entry.Name()), depth+1) {
+						if !visitDir(filepath.Join(path, entry.Name()), depth+1, under) {
 							return false
 						}
 					} else {
-						if !yield(filepath.Join(path, entry.Name()), true) {
+						if !yieldFile(filepath.Join(path, entry.Name()), under) {
 							return false
 						}
 					}
 				}
 
-				if err != nil || len(entries) < di.BatchSize {
+				if di.Sorted || err != nil || len(entries) < di.BatchSize {
 					break
 				}
 			}
@@ -192,8 +264,23 @@ func (di *DirIter) FilesOnly(root string) iter.Seq2[string, bool] {
 		}
 
 		// Start the recursion
-		visit(root, 0)
+		visit(root, 0, false)
+	}
+}
+
+// sortDirEntries sorts entries as the paths found under
+// them sort: a directory by its name with a "/" after it,
+// so that "a.txt" comes before "a/b", and "a/b" before "a0".
+func sortDirEntries(entries []fs.DirEntry) {
+	key := func(e fs.DirEntry) string {
+		if e.IsDir() {
+			return e.Name() + "/"
+		}
+		return e.Name()
 	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
 }
 
 // AllDirsOnlyDirs returns all subdirectories of root.
@@ -1,11 +1,13 @@
 package b3
 
 import (
+	"flag"
 	"fmt"
 	//"io"
 	"iter"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -171,3 +173,69 @@ func TestWalkDirs_MaxDepth(t *testing.T) {
 		t.Fatalf("expected only 0 unique path in paths")
 	}
 }
+
+func TestWalkDirs_SkipDirPrunes(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(filepath.Join(root, "_build/deep/er"), 0700))
+	panicOn(os.MkdirAll(filepath.Join(root, "src/_gen"), 0700))
+	panicOn(os.WriteFile(filepath.Join(root, "_build/deep/er/x"), nil, 0600))
+	panicOn(os.WriteFile(filepath.Join(root, "src/_gen/y"), nil, 0600))
+	panicOn(os.WriteFile(filepath.Join(root, "src/z"), nil, 0600))
+
+	cfg := &Blake3SummerConfig{}
+	fs := flag.NewFlagSet("b3", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	panicOn(fs.Parse(nil))
+	panicOn(cfg.FinishConfig(fs))
+
+	var asked []string
+	di := NewDirIter()
+	di.SkipDir = func(dir string) bool {
+		asked = append(asked, dir)
+		return cfg.excludedName(filepath.Base(dir))
+	}
+	var got []string
+	for path, ok := range di.FilesOnly(root) {
+		if ok {
+			got = append(got, path)
+		}
+	}
+	if len(got) != 1 || got[0] != filepath.Join(root, "src/z") {
+		t.Fatalf("expected just src/z, got %v", got)
+	}
+	for _, dir := range asked {
+		if strings.Contains(dir, "deep") {
+			t.Fatalf("descended into the skipped _build: %v", asked)
+		}
+	}
+
+	if !cfg.shouldExclude("src/_gen/y") || cfg.shouldExclude("./src/z") || !cfg.shouldExclude("a/b~/c") {
+		t.Fatalf("shouldExclude is not component-aware")
+	}
+}
+
+func TestWalkDirs_FillsMap(t *testing.T) {
+
+	root := "test_root"
+
+	os.RemoveAll(root) // cleanup any prior test output.
+	defer os.RemoveAll(root)
+
+	panicOn(os.MkdirAll(filepath.Join(root, "a", "b"), 0700))
+	panicOn(os.MkdirAll(filepath.Join(root, "c"), 0700))
+	for _, path := range []string{"a/x", "a/b/y", "c/z"} {
+		panicOn(os.WriteFile(filepath.Join(root, path), []byte(path), 0600))
+	}
+
+	cfg := &Blake3SummerConfig{Globs: []string{"*"}}
+	files := make(map[string]bool)
+	cfg.WalkDirs([]string{filepath.Join(root, "a"), filepath.Join(root, "c")}, files)
+	if len(files) != 3 || !files[filepath.Join(root, "a", "b", "y")] || !files[filepath.Join(root, "c", "z")] {
+		t.Fatalf("WalkDirs found %v", files)
+	}
+}
@@ -0,0 +1,90 @@
+package b3
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+// xattrSupported says if lxattrs works on this platform.
+const xattrSupported = true
+
+// lxattrs returns the extended attributes of path, by
+// name, without following symlinks. A filesystem without
+// xattr support gives none, rather than an error.
+func lxattrs(path string) (attrs map[string][]byte, err error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := xattrCall(syscall.SYS_LLISTXATTR, p, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attrs = make(map[string][]byte)
+	for _, name := range bytes.Split(list, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := syscall.BytePtrFromString(string(name))
+		if err != nil {
+			return nil, err
+		}
+		val, err := xattrCall(syscall.SYS_LGETXATTR, p, n)
+		if err == syscall.ENODATA {
+			continue // removed since we listed it.
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = val
+	}
+	return attrs, nil
+}
+
+// xattrCall makes an llistxattr (name nil) or lgetxattr
+// system call, first asking for the size, then growing
+// the buffer if the attributes grew in between.
+func xattrCall(trap uintptr, path, name *byte) ([]byte, error) {
+	call := func(buf []byte) (int, error) {
+		var ptr unsafe.Pointer
+		if len(buf) > 0 {
+			ptr = unsafe.Pointer(&buf[0])
+		}
+		var r1 uintptr
+		var errno syscall.Errno
+		if name == nil {
+			r1, _, errno = syscall.Syscall(trap,
+				uintptr(unsafe.Pointer(path)), uintptr(ptr), uintptr(len(buf)))
+		} else {
+			r1, _, errno = syscall.Syscall6(trap,
+				uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(name)),
+				uintptr(ptr), uintptr(len(buf)), 0, 0)
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(r1), nil
+	}
+	for {
+		sz, err := call(nil)
+		if err != nil {
+			return nil, err
+		}
+		if sz == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, sz)
+		n, err := call(buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package b3
+
+import (
+	"fmt"
+)
+
+// xattrSupported says if lxattrs works on this platform.
+const xattrSupported = false
+
+// lxattrs is only implemented for Linux so far.
+func lxattrs(path string) (attrs map[string][]byte, err error) {
+	return nil, fmt.Errorf("b3 error: extended attributes are not supported on this platform")
+}